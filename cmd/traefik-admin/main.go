@@ -7,8 +7,10 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/notify"
 	"github.com/pheelee/traefik-admin/internal/server"
 	"github.com/pheelee/traefik-admin/logger"
 )
@@ -22,28 +24,76 @@ func check(err error) {
 func main() {
 	var port int
 	var cfgpath string
+	var historypath string
+	var accesspath string
+	var usegit bool
+	var healthstatus string
+	var webhooks string
+	var allowedusers string
+	var err error
 	var certresolver string
 	cfg := server.Config{}
 
 	flag.StringVar(&cfgpath, "ConfigPath", "", "path where the dynamic config files getting stored")
+	flag.StringVar(&historypath, "HistoryPath", "", "path where previous versions of the configs are kept, must not be watched by traefik (default: history next to ConfigPath)")
+	flag.StringVar(&accesspath, "AccessPath", "", "file holding the forward auth policies of the entries, must not be watched by traefik (default: access.yaml next to ConfigPath)")
+	flag.BoolVar(&usegit, "Git", false, "commit every change of the ConfigPath to git, the directory is initialized as repository if needed")
 	flag.StringVar(&cfg.WebRoot, "WebRoot", "", "defines the WebRoot containing index.html and static resources (for development)")
 	flag.StringVar(&certresolver, "CertResolver", "http01", "name of the cert resolver which is configured for traefik, e.g http01 or dns01")
+	flag.StringVar(&cfg.AuthProvider, "Auth", "indieauth", fmt.Sprintf("login provider for the admin ui and auth forwarding, one of %s", strings.Join(server.AuthProviders(), ", ")))
 	flag.StringVar(&cfg.AuthorizationEndpoint, "AuthEndpoint", "", "indieauth authorization endpoint for auth forwarding, e.g https://homeassistant.tld/auth/authorize")
+	flag.StringVar(&allowedusers, "AllowedUsers", "", "comma separated profile urls allowed to log in, e.g https://homeassistant.tld/ (default: everyone the authorization endpoint verifies)")
 	flag.StringVar(&cfg.CookieSecret, "CookieSecret", "", "secret to encode session cookie (use strong random string)")
 	flag.IntVar(&port, "Port", 8099, "Listening Port")
+	flag.DurationVar(&cfg.HealthInterval, "HealthInterval", 30*time.Second, "interval of the background health checks of all backends")
+	flag.StringVar(&cfg.HealthProbe.Path, "HealthPath", "", "check backends with a http request to this path instead of a tcp connect, the health check path of an entry takes precedence")
+	flag.StringVar(&healthstatus, "HealthStatus", "200-399", "range of http status codes considered healthy")
+	flag.DurationVar(&cfg.HealthProbe.Timeout, "HealthTimeout", 2*time.Second, "timeout of a single backend health check")
+	flag.BoolVar(&cfg.HealthProbe.InsecureSkipVerify, "HealthInsecure", false, "skip tls verification of https backends in health checks")
 
+	flag.StringVar(&webhooks, "Webhooks", "", "yaml file with the webhooks notified when a backend goes down or recovers")
 	flag.Parse()
 
 	if cfgpath == "" || certresolver == "" || cfg.CookieSecret == "" {
 		flag.CommandLine.Usage()
 		os.Exit(1)
 	}
+	if cfg.HealthInterval <= 0 {
+		check(fmt.Errorf("HealthInterval must be positive, got %s", cfg.HealthInterval))
+	}
+	cfg.HealthProbe.MinStatus, cfg.HealthProbe.MaxStatus, err = config.ParseStatusRange(healthstatus)
+	check(err)
+	for _, u := range strings.Split(allowedusers, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.AllowedUsers = append(cfg.AllowedUsers, u)
+		}
+	}
+	if cfg.AuthEnabled() && len(cfg.AllowedUsers) == 0 {
+		logger.Info("no AllowedUsers configured, every identity verified by the authorization endpoint can log in")
+	}
+	if webhooks != "" {
+		cfg.Webhooks, err = notify.LoadConfig(webhooks)
+		check(err)
+	}
 
-	config.Manager = config.ConfigManager{Path: cfgpath, CertResolver: certresolver}
+	if historypath == "" {
+		historypath = path.Join(path.Dir(path.Clean(cfgpath)), "history")
+	}
+	if accesspath == "" {
+		accesspath = path.Join(path.Dir(path.Clean(cfgpath)), "access.yaml")
+	}
+	config.Manager = config.ConfigManager{
+		Path:           cfgpath,
+		CertResolver:   certresolver,
+		HistoryPath:    historypath,
+		AccessPath:     accesspath,
+		Git:            usegit,
+		OnWriteFailure: server.FailedWrite,
+	}
 
 	// Create sys configs
 	mw := config.Config{
-		Path: path.Join(cfgpath, "sys_middlewares.yaml"),
+		Path: path.Join(cfgpath, config.SysMiddlewares),
 		HTTP: config.HTTP{
 			Middlewares: make(map[string]*config.Middleware),
 		},
@@ -61,25 +111,30 @@ func main() {
 		},
 	}
 
-	if cfg.AuthorizationEndpoint != "" {
+	if cfg.AuthEnabled() {
 		mw.HTTP.Middlewares[strings.Replace(config.FORWARDAUTH, "@file", "", -1)] = &config.Middleware{
 			ForwardAuth: config.ForwardAuth{
-				Address: fmt.Sprintf("http://localhost:%d/auth", port),
+				Address:             fmt.Sprintf("http://localhost:%d/auth", port),
+				AuthResponseHeaders: server.IdentityHeaders,
 			},
 		}
 	}
 
 	check(mw.Save())
+	check(config.Manager.InitGit())
 
 	// Add unique id for all configs
 	check(config.Manager.MigrateConfig())
 	// Migrate certResolver for all configs to the specified one
 	check(config.Manager.SetCertResolver(certresolver))
 	// if forward auth is disabled reflect this to all proxy entries
-	if cfg.AuthorizationEndpoint == "" {
+	if !cfg.AuthEnabled() {
 		check(config.Manager.SetForwardAuth(config.Remove))
 	}
 
+	// keep track of changes made by hand or by other instances
+	check(config.Manager.Watch())
+
 	r := server.SetupRoutes(cfg)
 	logger.Info(fmt.Sprintf("Starting server on :%d", port))
 	panic(http.ListenAndServe(fmt.Sprintf(":%d", port), r))
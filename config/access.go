@@ -0,0 +1,271 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheelee/traefik-admin/helpers"
+	"gopkg.in/yaml.v2"
+)
+
+// AccessPolicy restricts who passes the forward auth of an entry. Allow and
+// Deny hold identities (profile urls) or groups prefixed with @, a match in
+// Deny always wins. Everyone who is logged in passes if Allow is empty.
+type AccessPolicy struct {
+	Allow []string `yaml:"allow,omitempty" json:"allow"`
+	Deny  []string `yaml:"deny,omitempty" json:"deny"`
+}
+
+// Access holds the policies keyed by the id of their entry and the groups of
+// identities referenced by them
+type Access struct {
+	Groups   map[string][]string      `yaml:"groups,omitempty" json:"groups"`
+	Policies map[string]*AccessPolicy `yaml:"policies,omitempty" json:"policies"`
+}
+
+// accessCache keeps the parsed access file until it is modified, the forward
+// auth reads it on every request
+var accessCache struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	access  *Access
+}
+
+func (p *AccessPolicy) empty() bool {
+	return p == nil || len(p.Allow) == 0 && len(p.Deny) == 0
+}
+
+// canonicalHost strips the port and lowercases the host
+func canonicalHost(h string) string {
+	if i := strings.LastIndex(h, ":"); i != -1 && !strings.Contains(h[i:], "]") {
+		h = h[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(h))
+}
+
+// sameIdentity compares profile urls ignoring case and a trailing slash
+func sameIdentity(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(strings.TrimSpace(a), "/"), strings.TrimSuffix(strings.TrimSpace(b), "/"))
+}
+
+// Policy returns the policy of the entry or nil
+func (a *Access) Policy(id string) *AccessPolicy {
+	return a.Policies[id]
+}
+
+// GroupsOf returns the groups the identity is a member of, the groups of the
+// login provider are added to them
+func (a *Access) GroupsOf(me string, groups []string) []string {
+	gl := append([]string{}, groups...)
+	for g, members := range a.Groups {
+		for _, m := range members {
+			if sameIdentity(m, me) && !contains(gl, g) {
+				gl = append(gl, g)
+				break
+			}
+		}
+	}
+	return gl
+}
+
+// Allowed evaluates the policy of the entry for the identity and its groups
+func (a *Access) Allowed(id string, me string, groups []string) bool {
+	p := a.Policy(id)
+	if p.empty() {
+		return true
+	}
+	groups = a.GroupsOf(me, groups)
+	matches := func(list []string) bool {
+		for _, e := range list {
+			if strings.HasPrefix(e, "@") {
+				for _, g := range groups {
+					if strings.EqualFold(e[1:], g) {
+						return true
+					}
+				}
+			} else if sameIdentity(e, me) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(p.Deny) {
+		return false
+	}
+	return len(p.Allow) == 0 || matches(p.Allow)
+}
+
+// Access reads the access file, it is empty if the file does not exist
+func (m *ConfigManager) Access() (*Access, error) {
+	a := &Access{Groups: map[string][]string{}, Policies: map[string]*AccessPolicy{}}
+	if m.AccessPath == "" {
+		return a, nil
+	}
+	fi, err := os.Stat(m.AccessPath)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	accessCache.Lock()
+	defer accessCache.Unlock()
+	if accessCache.path == m.AccessPath && accessCache.modTime.Equal(fi.ModTime()) {
+		return accessCache.access, nil
+	}
+	b, err := ioutil.ReadFile(m.AccessPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, a); err != nil {
+		return nil, err
+	}
+	if a.Groups == nil {
+		a.Groups = map[string][]string{}
+	}
+	if a.Policies == nil {
+		a.Policies = map[string]*AccessPolicy{}
+	}
+	accessCache.path, accessCache.modTime, accessCache.access = m.AccessPath, fi.ModTime(), a
+	return a, nil
+}
+
+// SaveAccess replaces the access file
+func (m *ConfigManager) SaveAccess(a *Access) (err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("access", err) }()
+	return m.saveAccess(a)
+}
+
+func (m *ConfigManager) saveAccess(a *Access) error {
+	b, err := yaml.Marshal(a)
+	if err != nil {
+		return err
+	}
+	accessCache.Lock()
+	defer accessCache.Unlock()
+	// the modification time may not change within the resolution of the filesystem
+	accessCache.path = ""
+	return helpers.WriteFileAtomic(m.AccessPath, b, 0600)
+}
+
+// setAccessPolicy moves the policy of the entry old to the entry id, a nil
+// policy keeps the current one and an empty policy removes it. old is empty
+// for new entries and id for deleted ones. The returned function restores the
+// previous policies if writing the entry fails.
+func (m *ConfigManager) setAccessPolicy(old string, id string, p *AccessPolicy) (func(), error) {
+	if m.AccessPath == "" || old == id && p == nil {
+		return func() {}, nil
+	}
+	a, err := m.Access()
+	if err != nil {
+		return nil, err
+	}
+	if p == nil && a.Policies[old] == nil {
+		return func() {}, nil
+	}
+	// the cached value is shared with readers
+	policies := map[string]*AccessPolicy{}
+	for k, v := range a.Policies {
+		policies[k] = v
+	}
+	current := policies[old]
+	delete(policies, old)
+	if p != nil {
+		current = p
+	}
+	if id != "" && !current.empty() {
+		policies[id] = current
+	}
+	if err = m.saveAccess(&Access{Groups: a.Groups, Policies: policies}); err != nil {
+		return nil, err
+	}
+	return func() { m.saveAccess(a) }, nil
+}
+
+// LoadAccessPolicy sets the policy of the entry from the access file
+func (m *ConfigManager) LoadAccessPolicy(u *UserInput) error {
+	a, err := m.Access()
+	if err != nil {
+		return err
+	}
+	u.AccessPolicy = a.Policy(u.ID)
+	return nil
+}
+
+// EntriesOf returns the ids of the http entries traefik routes the request
+// to. The most specific path wins, several entries are returned if their
+// rules only differ in headers or methods.
+func (m *ConfigManager) EntriesOf(host string, uri string) ([]string, error) {
+	ul, err := m.ListUserInputs()
+	if err != nil {
+		return nil, err
+	}
+	host = canonicalHost(host)
+	if i := strings.IndexAny(uri, "?#"); i != -1 {
+		uri = uri[:i]
+	}
+	ids, best := []string{}, -1
+	for _, u := range ul {
+		score := u.rule().match(host, uri)
+		switch {
+		case score > best:
+			ids, best = []string{u.ID}, score
+		case score == best && score >= 0:
+			ids = append(ids, u.ID)
+		}
+	}
+	return ids, nil
+}
+
+// match returns how specific the rule matches the host and the path, -1 if
+// it does not match. Rules written by hand are matched by the hosts they
+// mention.
+func (r Rule) match(host string, p string) int {
+	if r.Raw != "" {
+		if strings.Contains(strings.ToLower(r.Raw), "`"+host+"`") {
+			return 0
+		}
+		return -1
+	}
+	hosts := spliceEmpty(r.Hosts)
+	ok := len(hosts) == 0
+	for _, h := range hosts {
+		ok = ok || canonicalHost(h) == host
+	}
+	if !ok {
+		return -1
+	}
+	paths, prefixes := spliceEmpty(r.Path), spliceEmpty(r.PathPrefix)
+	if len(paths) == 0 && len(prefixes) == 0 {
+		return 0
+	}
+	score := -1
+	for _, e := range prefixes {
+		if strings.HasPrefix(p, e) && len(e) > score {
+			score = len(e)
+		}
+	}
+	// exact paths are more specific than any prefix
+	for _, e := range paths {
+		if p == e {
+			score = 1<<16 + len(e)
+		}
+	}
+	return score
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
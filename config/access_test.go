@@ -0,0 +1,130 @@
+package config
+
+import (
+	"path"
+	"testing"
+)
+
+func TestAccessAllowed(t *testing.T) {
+	a := &Access{
+		Groups: map[string][]string{"admins": {"https://alice.example.com/"}},
+		Policies: map[string]*AccessPolicy{
+			"Grafana_01234567": {Allow: []string{"@admins", "https://bob.example.com"}},
+			"Wiki_01234567":    {Deny: []string{"https://mallory.example.com/"}},
+		},
+	}
+	tests := []struct {
+		id     string
+		me     string
+		groups []string
+		ok     bool
+	}{
+		{"Grafana_01234567", "https://alice.example.com", nil, true},
+		{"Grafana_01234567", "https://bob.example.com/", nil, true},
+		{"Grafana_01234567", "https://carol.example.com/", nil, false},
+		{"Grafana_01234567", "https://carol.example.com/", []string{"admins"}, true},
+		{"Wiki_01234567", "https://carol.example.com/", nil, true},
+		{"Wiki_01234567", "https://mallory.example.com", nil, false},
+		{"Other_01234567", "https://mallory.example.com/", nil, true},
+	}
+	for _, tt := range tests {
+		if ok := a.Allowed(tt.id, tt.me, tt.groups); ok != tt.ok {
+			t.Errorf("%s on %s should be %v", tt.me, tt.id, tt.ok)
+		}
+	}
+
+	if g := a.GroupsOf("https://alice.example.com", []string{"admins", "staff"}); len(g) != 2 {
+		t.Errorf("Groups should not repeat %v", g)
+	}
+
+	a.Policies["Grafana_01234567"].Deny = []string{"@admins"}
+	if a.Allowed("Grafana_01234567", "https://alice.example.com/", nil) {
+		t.Errorf("Deny should win over allow")
+	}
+}
+
+func TestAccessPolicyOfEntries(t *testing.T) {
+	dir := t.TempDir()
+	M := ConfigManager{Path: dir, CertResolver: "http01", AccessPath: path.Join(t.TempDir(), "access.yaml")}
+	u := ui
+	u.Name, u.Domain = "Grafana", "grafana.example.com"
+	u.AccessPolicy = &AccessPolicy{Allow: []string{"https://alice.example.com/"}}
+	c, err := M.Add(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := M.Access()
+	if p := a.Policy(c.ID()); p == nil || p.Allow[0] != "https://alice.example.com/" {
+		t.Fatalf("Policy should be stored for the entry %+v", a.Policies)
+	}
+	ul, _ := M.ListUserInputs()
+	if len(ul) != 1 || ul[0].AccessPolicy == nil {
+		t.Errorf("Policy should be listed with the entry %+v", ul)
+	}
+
+	// a second entry on the same host
+	api := ui
+	api.Name, api.Domain, api.Rule = "Api", "", Rule{Hosts: []string{"grafana.example.com"}, PathPrefix: []string{"/api"}}
+	api.AccessPolicy = &AccessPolicy{Allow: []string{"https://bob.example.com/"}}
+	ac, err := M.Add(&api)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := func(host string, uri string) []string {
+		ids, err := M.EntriesOf(host, uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if ids := entries("Grafana.example.com:443", "/api/health?x=1"); len(ids) != 1 || ids[0] != ac.ID() {
+		t.Errorf("Most specific entry should match %v", ids)
+	}
+	if ids := entries("grafana.example.com", "/"); len(ids) != 1 || ids[0] != c.ID() {
+		t.Errorf("Host entry should match %v", ids)
+	}
+	if ids := entries("other.example.com", "/"); len(ids) != 0 {
+		t.Errorf("No entry should match %v", ids)
+	}
+
+	// nil keeps the policy, the policy moves with the id
+	u.ID, u.Name, u.AccessPolicy = c.ID(), "Dashboards", nil
+	if c, err = M.Update(&u); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = M.Access()
+	if len(a.Policies) != 2 || a.Policy(c.ID()) == nil || a.Policy(ac.ID()) == nil {
+		t.Errorf("Policy should move with the entry %+v", a.Policies)
+	}
+
+	// an empty policy removes it without touching the other entry
+	u.ID, u.AccessPolicy = c.ID(), &AccessPolicy{}
+	if c, err = M.Update(&u); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = M.Access()
+	if len(a.Policies) != 1 || a.Policy(ac.ID()) == nil {
+		t.Errorf("Only the policy of the entry should be removed %+v", a.Policies)
+	}
+
+	if err = M.Delete(ac.ID(), ""); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = M.Access()
+	if len(a.Policies) != 0 {
+		t.Errorf("Policy should be removed with the entry %+v", a.Policies)
+	}
+
+	// the policy is rolled back if the entry can't be written
+	undo, err := M.setAccessPolicy("", "Api_01234567", api.AccessPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ = M.Access(); len(a.Policies) != 1 {
+		t.Fatalf("Policy should be stored %+v", a.Policies)
+	}
+	undo()
+	if a, _ = M.Access(); len(a.Policies) != 0 {
+		t.Errorf("Policy should be rolled back %+v", a.Policies)
+	}
+}
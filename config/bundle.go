@@ -0,0 +1,357 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/pheelee/traefik-admin/helpers"
+	"gopkg.in/yaml.v2"
+)
+
+// SysMiddlewares is the file holding the middlewares shared by all entries
+const SysMiddlewares = "sys_middlewares.yaml"
+
+// ImportMode defines how an import treats the existing entries
+type ImportMode string
+
+const (
+	// ImportMerge adds new entries and updates existing ones, the local sys
+	// middlewares are kept because all other entries depend on them
+	ImportMerge ImportMode = "merge"
+	// ImportReplace additionally deletes all entries missing in the bundle and
+	// replaces the sys middlewares if the bundle carries them
+	ImportReplace ImportMode = "replace"
+)
+
+// Bundle holds all entries of an installation for export and import
+type Bundle struct {
+	Entries        []UserInput   `json:"entries"`
+	Streams        []StreamInput `json:"streams"`
+	SysMiddlewares string        `json:"sysMiddlewares,omitempty"`
+}
+
+// ImportResult describes the changes of an import, nothing is applied if any
+// entry is invalid or if it was a dry run. If writing fails all files written
+// by the import are restored.
+type ImportResult struct {
+	Mode    ImportMode    `json:"mode"`
+	DryRun  bool          `json:"dryRun"`
+	Valid   bool          `json:"valid"`
+	Applied bool          `json:"applied"`
+	Entries []ImportEntry `json:"entries"`
+}
+
+// ImportEntry is the planned change and validation result of a single entry
+type ImportEntry struct {
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Action           string            `json:"action"`
+	Valid            bool              `json:"valid"`
+	Error            string            `json:"error,omitempty"`
+	Validation       *Validation       `json:"validation,omitempty"`
+	StreamValidation *StreamValidation `json:"streamValidation,omitempty"`
+}
+
+// Export returns all entries and the sys middlewares as bundle
+func (m *ConfigManager) Export() (*Bundle, error) {
+	var err error
+	b := &Bundle{}
+	if b.Entries, err = m.ListUserInputs(); err != nil {
+		return nil, err
+	}
+	if b.Streams, err = m.ListStreamInputs(); err != nil {
+		return nil, err
+	}
+	for i := range b.Entries {
+		b.Entries[i].Revision = ""
+	}
+	for i := range b.Streams {
+		b.Streams[i].Revision = ""
+	}
+	sys, err := ioutil.ReadFile(path.Join(m.Path, SysMiddlewares))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	b.SysMiddlewares = string(sys)
+	return b, nil
+}
+
+// YAML returns the bundle as yaml document using the same keys as the json api
+func (b *Bundle) YAML() ([]byte, error) {
+	j, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err = json.Unmarshal(j, &v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// ParseBundle reads a bundle exported as json or yaml
+func ParseBundle(data []byte) (*Bundle, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	j, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{}
+	if err = json.Unmarshal(j, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// jsonCompatible converts the maps decoded by yaml to maps with string keys
+func jsonCompatible(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range t {
+			t[i] = jsonCompatible(e)
+		}
+	}
+	return v
+}
+
+var bundleHash = regexp.MustCompile("^[0-9a-f]{8}$")
+
+// importID keeps the hash of the exported id so entries keep their id across
+// installations
+func importID(id string, name string) string {
+	if _, h := splitID(id); bundleHash.MatchString(h) {
+		return name + "_" + h
+	}
+	return name + "_" + RandHash()
+}
+
+// splitID returns the name and hash part of an id
+func splitID(id string) (string, string) {
+	for i := len(id) - 1; i >= 0; i-- {
+		if id[i] == '_' {
+			return id[:i], id[i+1:]
+		}
+	}
+	return id, ""
+}
+
+// Import applies the bundle, existing entries are matched by the hash part of
+// their id. All entries are validated and converted first and nothing is
+// written unless all of them are valid. A failed write rolls back the changes
+// applied so far.
+func (m *ConfigManager) Import(b *Bundle, mode ImportMode, dryRun bool) (res *ImportResult, err error) {
+	if mode != ImportMerge && mode != ImportReplace {
+		return nil, fmt.Errorf("unknown import mode %s", mode)
+	}
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("import", err) }()
+	cl, err := m.List()
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]*Config{}
+	for i := range cl {
+		if err = cl[i].Load(); err != nil {
+			return nil, err
+		}
+		_, h := splitID(cl[i].ID())
+		existing[h] = &cl[i]
+	}
+
+	// rules of all http entries after the import, keyed by the hash of their id
+	rules := map[string]UserInput{}
+	if mode == ImportMerge {
+		for i := range cl {
+			if cl[i].Protocol() != "" {
+				continue
+			}
+			if u, err := cl[i].ToUserInput(); err == nil {
+				_, h := splitID(u.ID)
+				rules[h] = *u
+			}
+		}
+	}
+	// entries without a known hash get a new one, keep it for the whole import
+	ids := make([]string, len(b.Entries))
+	for i, u := range b.Entries {
+		ids[i] = importID(u.ID, u.Name)
+		_, h := splitID(ids[i])
+		rules[h] = u
+	}
+
+	res = &ImportResult{Mode: mode, DryRun: dryRun, Valid: true, Entries: []ImportEntry{}}
+	// every step returns a function undoing its changes
+	apply := []func() (func(), error){}
+	seen := map[string]bool{}
+	plan := func(e ImportEntry, policy *AccessPolicy, convert func(id string) *Config) {
+		_, h := splitID(e.ID)
+		old := existing[h]
+		switch {
+		case seen[h]:
+			e.Valid, e.Error = false, "duplicate id"
+		case old != nil:
+			e.Action = "update"
+			e.ID = renameID(old.ID(), e.Name)
+		default:
+			e.Action = "add"
+		}
+		seen[h] = true
+		var c *Config
+		if e.Valid {
+			if c = convert(e.ID); c == nil {
+				e.Valid, e.Error = false, "invalid entry"
+			}
+		}
+		res.Valid = res.Valid && e.Valid
+		res.Entries = append(res.Entries, e)
+		if !e.Valid {
+			return
+		}
+		apply = append(apply, func() (func(), error) {
+			oldID := ""
+			if old != nil {
+				oldID = old.ID()
+			}
+			// the policy is stored first so the entry is never reachable without it
+			undoPolicy, err := m.setAccessPolicy(oldID, c.id, policy)
+			if err != nil {
+				return nil, err
+			}
+			p := path.Join(m.Path, c.id+".yaml")
+			if old == nil {
+				undo, err := backup(p)
+				if err == nil {
+					_, err = m.create(c)
+				}
+				return func() {
+					undo()
+					undoPolicy()
+				}, err
+			}
+			undoOld, err := backup(old.Path)
+			if err == nil {
+				var undoNew func()
+				if undoNew, err = backup(p); err == nil {
+					if _, err = m.replace(old, c); err == nil {
+						return func() {
+							undoNew()
+							undoOld()
+							m.moveHistory(c.id, old.ID())
+							undoPolicy()
+						}, nil
+					}
+				}
+			}
+			// replace cleans up itself
+			return undoPolicy, err
+		})
+	}
+	for i := range b.Entries {
+		u := &b.Entries[i]
+		v := u.Validate()
+		id := ids[i]
+		_, self := splitID(id)
+		for h, o := range rules {
+			if d := u.rule().conflicts(o.rule()); h != self && d != "" {
+				v.Valid = false
+				v.Errors.Domain = (&DomainConflict{Entry: o.ID, Name: o.Name, Host: d}).Error()
+			}
+		}
+		plan(ImportEntry{ID: id, Name: u.Name, Valid: v.Valid, Validation: &v}, u.AccessPolicy, func(id string) *Config {
+			u.hashedPasswords = true
+			return fromUserInput(u, m.CertResolver, id)
+		})
+	}
+	for i := range b.Streams {
+		s := &b.Streams[i]
+		v := s.Validate()
+		plan(ImportEntry{ID: importID(s.ID, s.Name), Name: s.Name, Valid: v.Valid, StreamValidation: &v}, nil, func(id string) *Config {
+			return fromStreamInput(s, m.CertResolver, id)
+		})
+	}
+	if mode == ImportReplace {
+		for i := range cl {
+			c := &cl[i]
+			if _, h := splitID(c.ID()); seen[h] {
+				continue
+			}
+			res.Entries = append(res.Entries, ImportEntry{ID: c.ID(), Name: c.Name(), Action: "delete", Valid: true})
+			apply = append(apply, func() (func(), error) {
+				undo, err := backup(c.Path)
+				if err != nil {
+					return nil, err
+				}
+				if err = m.remove(c); err != nil {
+					return undo, err
+				}
+				undoPolicy, err := m.setAccessPolicy(c.ID(), "", nil)
+				if err != nil {
+					return undo, err
+				}
+				return func() {
+					undo()
+					undoPolicy()
+				}, nil
+			})
+		}
+		if b.SysMiddlewares != "" {
+			res.Entries = append(res.Entries, ImportEntry{ID: "sys_middlewares", Action: "update", Valid: true})
+			apply = append(apply, func() (func(), error) {
+				p := path.Join(m.Path, SysMiddlewares)
+				undo, err := backup(p)
+				if err == nil {
+					err = helpers.WriteFileAtomic(p, []byte(b.SysMiddlewares), 0644)
+				}
+				return undo, err
+			})
+		}
+	}
+
+	if dryRun || !res.Valid {
+		return res, nil
+	}
+	undo := []func(){}
+	for _, f := range apply {
+		u, err := f()
+		if u != nil {
+			undo = append(undo, u)
+		}
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+			m.invalidate()
+			return res, err
+		}
+	}
+	res.Applied = true
+	m.commitf("Import bundle (%s)", mode)
+	return res, nil
+}
+
+// backup returns a function restoring the file to its current content, the
+// file is removed if it does not exist yet
+func backup(p string) (func(), error) {
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return func() { os.Remove(p) }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() { helpers.WriteFileAtomic(p, b, 0644) }, nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	ioutil.WriteFile(path.Join(src.Path, SysMiddlewares), []byte("http: {}\n"), 0644)
+	c, err := src.Add(&UserInput{
+		Name:      "Test",
+		Domain:    "test.example.com",
+		HTTPS:     true,
+		Backends:  []Backend{{URL: "http://1.2.3.4:80"}},
+		BasicAuth: []basicAuthInput{{Username: "user", Password: "secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = src.AddStream(&mqtt); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := src.Export()
+	if err != nil || len(bundle.Entries) != 1 || len(bundle.Streams) != 1 || bundle.SysMiddlewares != "http: {}\n" {
+		t.Fatalf("Wrong export %+v %v", bundle, err)
+	}
+	y, err := bundle.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle, err = ParseBundle(y); err != nil || bundle.Entries[0].ID != c.ID() {
+		t.Fatalf("Yaml should round trip %+v %v", bundle, err)
+	}
+
+	dst := ConfigManager{Path: t.TempDir(), CertResolver: "dns01"}
+	other, _ := dst.Add(&UserInput{Name: "Other", Domain: "other.example.com", Backends: []Backend{{URL: "http://1.2.3.5:80"}}})
+	res, err := dst.Import(bundle, ImportReplace, true)
+	if err != nil || !res.Valid || res.Applied || len(res.Entries) != 4 {
+		t.Fatalf("Wrong dry run %+v %v", res, err)
+	}
+	if dst.Get(c.ID()) != nil || dst.Get(other.ID()) == nil {
+		t.Fatal("Dry run should not change anything")
+	}
+	if res, err = dst.Import(bundle, ImportReplace, false); err != nil || !res.Applied {
+		t.Fatalf("Should be applied %+v %v", res, err)
+	}
+	if dst.Get(other.ID()) != nil {
+		t.Error("Replace should delete other entries")
+	}
+	imported := dst.Get(c.ID())
+	if imported == nil {
+		t.Fatal("Should keep the id")
+	}
+	u, _ := imported.ToUserInput()
+	want, _ := src.Get(c.ID()).ToUserInput()
+	if u.BasicAuth[0] != want.BasicAuth[0] {
+		t.Errorf("Password hash should be kept %+v", u.BasicAuth[0])
+	}
+
+	bundle.Entries[0].Name = "X"
+	if res, _ = dst.Import(bundle, ImportMerge, false); res.Valid || res.Applied || res.Entries[0].Validation.Errors.Name == "" {
+		t.Errorf("Invalid entries should be reported %+v", res)
+	}
+	bundle.Entries[0].Name = "Renamed"
+	if res, _ = dst.Import(bundle, ImportMerge, false); !res.Applied || res.Entries[0].Action != "update" || dst.Get("Renamed_"+c.ID()[5:]) == nil {
+		t.Errorf("Should rename the existing entry %+v", res)
+	}
+}
+
+func TestImportRollback(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	old, err := M.Add(&UserInput{Name: "Old", Domain: "old.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := M.Add(&UserInput{Name: "Kept", Domain: "kept.example.com", Backends: []Backend{{URL: "http://1.2.3.5:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := kept.ToUserInput()
+	u.Name = "Renamed"
+	bundle := &Bundle{
+		Entries: []UserInput{
+			*u,
+			{Name: "New", Domain: "new.example.com", Backends: []Backend{{URL: "http://1.2.3.6:80"}}},
+		},
+		SysMiddlewares: "http: {}\n",
+	}
+	// writing the sys middlewares fails after all entries were applied
+	os.Mkdir(path.Join(M.Path, SysMiddlewares), 0755)
+	os.WriteFile(path.Join(M.Path, SysMiddlewares, "x"), nil, 0644)
+
+	res, err := M.Import(bundle, ImportReplace, false)
+	if err == nil || res.Applied {
+		t.Fatalf("Import should fail %+v", res)
+	}
+	ul, _ := M.ListUserInputs()
+	if len(ul) != 2 || M.Get(old.ID()) == nil || M.Get(kept.ID()) == nil {
+		t.Errorf("All changes should be rolled back %+v", ul)
+	}
+}
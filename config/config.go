@@ -7,18 +7,26 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/pheelee/traefik-admin/helpers"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
 )
 
 // Config holds a dynamic traefik config
 type Config struct {
-	Path   string `yaml:"-"`
-	id     string `yaml:"-"`
-	loaded bool   `yaml:"-"`
-	HTTP   HTTP   `yaml:"http"`
+	Path     string                 `yaml:"-"`
+	id       string                 `yaml:"-"`
+	loaded   bool                   `yaml:"-"`
+	revision string                 `yaml:"-"`
+	HTTP     HTTP                   `yaml:"http,omitempty"`
+	TCP      TCP                    `yaml:"tcp,omitempty"`
+	UDP      UDP                    `yaml:"udp,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // HTTP defines the http entry struct of traefik
@@ -26,32 +34,78 @@ type HTTP struct {
 	Routers     map[string]*Router     `yaml:"routers,omitempty"`
 	Services    map[string]*Service    `yaml:"services,omitempty"`
 	Middlewares map[string]*Middleware `yaml:"middlewares,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // Router holds the config part for the router
 type Router struct {
-	Entrypoints []string         `yaml:"entryPoints,omitempty"`
-	Rule        string           `yaml:"rule"`
-	Service     string           `yaml:"service,omitempty"`
-	TLS         *routerTLSConfig `yaml:"tls,omitempty"`
-	Middlewares []string         `yaml:"middlewares,omitempty"`
+	Entrypoints []string               `yaml:"entryPoints,omitempty"`
+	Rule        string                 `yaml:"rule"`
+	Service     string                 `yaml:"service,omitempty"`
+	TLS         *routerTLSConfig       `yaml:"tls,omitempty"`
+	Middlewares []string               `yaml:"middlewares,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 type routerTLSConfig struct {
-	CertResolver string `yaml:"certResolver"`
+	CertResolver string                 `yaml:"certResolver"`
+	Extra        map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // Service holds the config part for service
 type Service struct {
-	LoadBalancer loadbalancer `yaml:"loadBalancer"`
+	LoadBalancer loadbalancer           `yaml:"loadBalancer,omitempty"`
+	Weighted     weighted               `yaml:"weighted,omitempty"`
+	Extra        map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 type loadbalancer struct {
-	Servers []server
+	Servers        []server
+	HealthCheck    *healthCheck           `yaml:"healthCheck,omitempty"`
+	Sticky         *sticky                `yaml:"sticky,omitempty"`
+	PassHostHeader *bool                  `yaml:"passHostHeader,omitempty"`
+	Extra          map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 type server struct {
-	URL string `yaml:"url"`
+	URL   string                 `yaml:"url"`
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type healthCheck struct {
+	Path     string                 `yaml:"path,omitempty"`
+	Interval string                 `yaml:"interval,omitempty"`
+	Timeout  string                 `yaml:"timeout,omitempty"`
+	Scheme   string                 `yaml:"scheme,omitempty"`
+	Headers  map[string]string      `yaml:"headers,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type sticky struct {
+	Cookie *stickyCookie          `yaml:"cookie,omitempty"`
+	Extra  map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type stickyCookie struct {
+	Name     string                 `yaml:"name,omitempty"`
+	Secure   bool                   `yaml:"secure,omitempty"`
+	HTTPOnly bool                   `yaml:"httpOnly,omitempty"`
+	SameSite string                 `yaml:"sameSite,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// weighted is the traefik weighted round robin service which spreads the
+// requests over other services
+type weighted struct {
+	Services []weightedService      `yaml:"services,omitempty"`
+	Sticky   *sticky                `yaml:"sticky,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type weightedService struct {
+	Name   string                 `yaml:"name"`
+	Weight int                    `yaml:"weight"`
+	Extra  map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 func (c *Config) Load() error {
@@ -64,6 +118,7 @@ func (c *Config) Load() error {
 			return err
 		}
 		c.loaded = true
+		c.revision = revision(b)
 		return nil
 	}
 	return nil
@@ -89,6 +144,139 @@ func (h *HTTP) containsRouter(name string) bool {
 	return ok
 }
 
+// backends returns the backends of the service with the given name. A weighted
+// service is resolved to the servers of its child services.
+func (h *HTTP) backends(name string) []Backend {
+	b := []Backend{}
+	s, ok := h.Services[name]
+	if !ok {
+		return b
+	}
+	for _, ws := range s.Weighted.Services {
+		for _, cb := range h.backends(ws.Name) {
+			cb.Weight = ws.Weight
+			b = append(b, cb)
+		}
+	}
+	for _, srv := range s.LoadBalancer.Servers {
+		b = append(b, Backend{URL: srv.URL})
+	}
+	return b
+}
+
+// loadBalancerInput returns the load balancer options of the service with the
+// given name. For a weighted service the sticky cookie is taken from the
+// weighted service and the other options from its first child.
+func (h *HTTP) loadBalancerInput(name string) *loadBalancerInput {
+	in := &loadBalancerInput{HealthCheck: healthCheckInput{Headers: make([]headersInput, 5)}}
+	s, ok := h.Services[name]
+	if !ok {
+		return in
+	}
+	lb := s.LoadBalancer
+	st := lb.Sticky
+	if len(s.Weighted.Services) > 0 {
+		st = s.Weighted.Sticky
+		if c, ok := h.Services[s.Weighted.Services[0].Name]; ok {
+			lb = c.LoadBalancer
+		}
+	}
+	passHostHeader := lb.PassHostHeader == nil || *lb.PassHostHeader
+	in.PassHostHeader = &passHostHeader
+	if lb.HealthCheck != nil {
+		in.HealthCheck.Path = lb.HealthCheck.Path
+		in.HealthCheck.Interval = lb.HealthCheck.Interval
+		in.HealthCheck.Timeout = lb.HealthCheck.Timeout
+		in.HealthCheck.Scheme = lb.HealthCheck.Scheme
+		names := []string{}
+		for n := range lb.HealthCheck.Headers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		// the form shows at least 5 rows, more headers are kept as well
+		if len(names) > len(in.HealthCheck.Headers) {
+			in.HealthCheck.Headers = make([]headersInput, len(names))
+		}
+		for i, n := range names {
+			in.HealthCheck.Headers[i] = headersInput{Name: n, Value: lb.HealthCheck.Headers[n]}
+		}
+	}
+	if st != nil && st.Cookie != nil {
+		in.Sticky = stickyInput{
+			Enabled:  true,
+			Name:     st.Cookie.Name,
+			Secure:   st.Cookie.Secure,
+			HTTPOnly: st.Cookie.HTTPOnly,
+			SameSite: st.Cookie.SameSite,
+		}
+	}
+	return in
+}
+
+// newLoadBalancer creates a load balancer for the given backends with the
+// options of the user input, the sticky cookie is only set if requested
+func newLoadBalancer(backends []Backend, in *loadBalancerInput, withSticky bool) loadbalancer {
+	lb := loadbalancer{Servers: []server{}}
+	for _, b := range backends {
+		lb.Servers = append(lb.Servers, server{URL: b.URL})
+	}
+	if in == nil {
+		return lb
+	}
+	if in.PassHostHeader != nil && !*in.PassHostHeader {
+		f := false
+		lb.PassHostHeader = &f
+	}
+	if in.HealthCheck.Path != "" {
+		lb.HealthCheck = &healthCheck{
+			Path:     in.HealthCheck.Path,
+			Interval: in.HealthCheck.Interval,
+			Timeout:  in.HealthCheck.Timeout,
+			Scheme:   in.HealthCheck.Scheme,
+		}
+		for _, h := range in.HealthCheck.Headers {
+			if h.Name != "" {
+				if lb.HealthCheck.Headers == nil {
+					lb.HealthCheck.Headers = make(map[string]string)
+				}
+				lb.HealthCheck.Headers[h.Name] = h.Value
+			}
+		}
+	}
+	if withSticky {
+		lb.Sticky = in.Sticky.toConfig()
+	}
+	return lb
+}
+
+// addServices creates the service for the given backends. Without weights all
+// servers share a single load balancer, otherwise every backend gets its own
+// service named <name>-<n> which are combined by a weighted service.
+func (h *HTTP) addServices(name string, backends []Backend, in *loadBalancerInput) {
+	weighted := false
+	for _, b := range backends {
+		weighted = weighted || b.Weight > 0
+	}
+	if !weighted {
+		h.Services[name] = &Service{LoadBalancer: newLoadBalancer(backends, in, true)}
+		return
+	}
+	s := &Service{}
+	for i, b := range backends {
+		child := fmt.Sprintf("%s-%d", name, i)
+		h.Services[child] = &Service{LoadBalancer: newLoadBalancer([]Backend{b}, in, false)}
+		w := b.Weight
+		if w == 0 {
+			w = 1
+		}
+		s.Weighted.Services = append(s.Weighted.Services, weightedService{Name: child, Weight: w})
+	}
+	if in != nil {
+		s.Weighted.Sticky = in.Sticky.toConfig()
+	}
+	h.Services[name] = s
+}
+
 func (h *HTTP) hasAnyRouterMiddleware(name string) bool {
 	for _, r := range h.Routers {
 		if r.hasMiddleware(name) {
@@ -113,11 +301,19 @@ func (c *Config) ToUserInput() (*UserInput, error) {
 		return nil, err
 	}
 	id := c.ID()
+	raw := c.HTTP.Routers[id+"-http"].Rule
+	rule, err := ParseRule(raw)
+	if err != nil {
+		// keep rules written by hand which traefik-admin can't parse as they are
+		rule = Rule{Raw: raw}
+	}
 	u := &UserInput{
 		ID:            id,
+		Revision:      c.revision,
 		Name:          c.Name(),
-		Domain:        strings.TrimSuffix(strings.TrimPrefix(c.HTTP.Routers[id+"-http"].Rule, "Host(`"), "`)"),
-		Backend:       Backend{URL: c.HTTP.Services[id].LoadBalancer.Servers[0].URL},
+		Rule:          rule,
+		Backends:      c.HTTP.backends(id),
+		LoadBalancer:  c.HTTP.loadBalancerInput(id),
 		ForwardAuth:   c.HTTP.hasAnyRouterMiddleware(FORWARDAUTH),
 		HTTPS:         c.HTTP.containsRouter(id) && c.HTTP.Routers[id].TLS != nil,
 		ForceTLS:      c.HTTP.containsRouter(id+"-http") && c.HTTP.Routers[id+"-http"].hasMiddleware(REDIRSCHEME),
@@ -125,6 +321,12 @@ func (c *Config) ToUserInput() (*UserInput, error) {
 		Headers:       make([]headersInput, 5),
 		BasicAuth:     make([]basicAuthInput, 5),
 		IPRestriction: &ipRestriction{Depth: 0, IPs: make([]string, 5)},
+		PathRewrite:   &pathRewrite{StripPrefix: []string{}, StripPrefixRegex: []string{}},
+		RateLimit:     &rateLimit{},
+		InFlight:      &inFlight{},
+	}
+	if len(rule.Hosts) > 0 {
+		u.Domain = rule.Hosts[0]
 	}
 	headers, ok := c.HTTP.Middlewares[id+"-headers"]
 	if ok {
@@ -152,15 +354,52 @@ func (c *Config) ToUserInput() (*UserInput, error) {
 			}
 		}
 	}
+	if mw, ok := c.HTTP.Middlewares[id+"-stripprefix"]; ok {
+		u.PathRewrite.StripPrefix = mw.StripPrefix.Prefixes
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-stripprefixregex"]; ok {
+		u.PathRewrite.StripPrefixRegex = mw.StripPrefixRegex.Regex
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-addprefix"]; ok {
+		u.PathRewrite.AddPrefix = mw.AddPrefix.Prefix
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-replacepath"]; ok {
+		u.PathRewrite.ReplacePath = mw.ReplacePath.Path
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-replacepathregex"]; ok {
+		u.PathRewrite.ReplacePathRegex = replacePathRegex{
+			Regex:       mw.ReplacePathRegex.Regex,
+			Replacement: mw.ReplacePathRegex.Replacement,
+		}
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-ratelimit"]; ok {
+		u.RateLimit = &rateLimit{
+			Average:         mw.RateLimit.Average,
+			Burst:           mw.RateLimit.Burst,
+			Period:          mw.RateLimit.Period,
+			SourceCriterion: mw.RateLimit.SourceCriterion.toInput(),
+		}
+	}
+	if mw, ok := c.HTTP.Middlewares[id+"-inflight"]; ok {
+		u.InFlight = &inFlight{
+			Amount:          mw.InFlightReq.Amount,
+			SourceCriterion: mw.InFlightReq.SourceCriterion.toInput(),
+		}
+	}
 	return u, nil
 }
 
 func FromUserInput(u *UserInput, certresolver string) *Config {
+	return fromUserInput(u, certresolver, u.Name+"_"+RandHash())
+}
+
+// fromUserInput converts the user input to a config with the given id
+func fromUserInput(u *UserInput, certresolver string, id string) *Config {
 	if !u.Validate().Valid {
 		return nil
 	}
 	c := &Config{
-		id: u.Name + "_" + RandHash(),
+		id: id,
 		HTTP: HTTP{
 			Routers:     map[string]*Router{},
 			Services:    make(map[string]*Service),
@@ -168,20 +407,12 @@ func FromUserInput(u *UserInput, certresolver string) *Config {
 		},
 	}
 	// Always add service
-	c.HTTP.Services[c.id] = &Service{
-		LoadBalancer: loadbalancer{
-			Servers: []server{
-				{
-					URL: u.Backend.URL,
-				},
-			},
-		},
-	}
+	c.HTTP.addServices(c.id, u.backends(), u.LoadBalancer)
 	// Always add http router
 	c.HTTP.Routers[c.id+"-http"] = &Router{
 		Entrypoints: []string{"web"},
 		Service:     c.id,
-		Rule:        fmt.Sprintf("Host(`%s`)", u.Domain),
+		Rule:        u.rule().String(),
 		Middlewares: []string{},
 	}
 	// https redirect middleware if specified
@@ -192,7 +423,7 @@ func FromUserInput(u *UserInput, certresolver string) *Config {
 	if u.HTTPS {
 		c.HTTP.Routers[c.id] = &Router{
 			Entrypoints: []string{"websecure"},
-			Rule:        fmt.Sprintf("Host(`%s`)", u.Domain),
+			Rule:        u.rule().String(),
 			Service:     c.id,
 			TLS: &routerTLSConfig{
 				CertResolver: certresolver,
@@ -223,11 +454,47 @@ func FromUserInput(u *UserInput, certresolver string) *Config {
 		}
 	}
 
+	// do we have path manipulations?
+	names, mws := pathMiddlewares(u.PathRewrite)
+	for _, n := range names {
+		c.HTTP.Middlewares[c.id+n] = mws[n]
+		for _, r := range c.HTTP.Routers {
+			r.Middlewares = append(r.Middlewares, c.id+n)
+		}
+	}
+
+	// do we have rate limiting?
+	if u.RateLimit != nil && u.RateLimit.Average > 0 {
+		c.HTTP.Middlewares[c.id+"-ratelimit"] = &Middleware{RateLimit: RateLimit{
+			Average:         u.RateLimit.Average,
+			Burst:           u.RateLimit.Burst,
+			Period:          u.RateLimit.Period,
+			SourceCriterion: (&SourceCriterion{}).fromInput(u.RateLimit.SourceCriterion),
+		}}
+		for _, r := range c.HTTP.Routers {
+			r.Middlewares = append(r.Middlewares, c.id+"-ratelimit")
+		}
+	}
+	if u.InFlight != nil && u.InFlight.Amount > 0 {
+		c.HTTP.Middlewares[c.id+"-inflight"] = &Middleware{InFlightReq: InFlightReq{
+			Amount:          u.InFlight.Amount,
+			SourceCriterion: (&SourceCriterion{}).fromInput(u.InFlight.SourceCriterion),
+		}}
+		for _, r := range c.HTTP.Routers {
+			r.Middlewares = append(r.Middlewares, c.id+"-inflight")
+		}
+	}
+
 	// do we have basic auth?
 	var users []string = make([]string, 0)
 	for _, ba := range u.BasicAuth {
 		if ba.Username != "" {
-			hash, _ := bcrypt.GenerateFromPassword([]byte(ba.Password), bcrypt.DefaultCost)
+			hash := []byte(ba.Password)
+			// only imports may carry hashes, anything submitted in the form is
+			// a password even if it looks like a hash
+			if _, err := bcrypt.Cost(hash); err != nil || !u.hashedPasswords {
+				hash, _ = bcrypt.GenerateFromPassword([]byte(ba.Password), bcrypt.DefaultCost)
+			}
 			users = append(users, ba.Username+":"+string(hash))
 		}
 	}
@@ -254,19 +521,198 @@ func FromUserInput(u *UserInput, certresolver string) *Config {
 	return c
 }
 
+// inherit takes over everything traefik-admin does not manage from the previous
+// version of the entry: unmodelled keys and hand added routers, services and
+// middlewares. References to the old names are renamed along with the entry.
+func (c *Config) inherit(old *Config) {
+	oid := old.ID()
+	rename := renamer(oid, c.id)
+	inheritExtra(reflect.ValueOf(c).Elem(), reflect.ValueOf(old).Elem(), rename)
+
+	for k, r := range old.HTTP.Routers {
+		nr, ok := c.HTTP.Routers[rename(k)]
+		if !ok {
+			if isManagedRouter(oid, k) {
+				continue
+			}
+			nr = &Router{
+				Entrypoints: r.Entrypoints,
+				Rule:        r.Rule,
+				Service:     rename(r.Service),
+				TLS:         r.TLS,
+				Extra:       renameRefs(r.Extra, rename).(map[string]interface{}),
+			}
+			if c.HTTP.Routers == nil {
+				c.HTTP.Routers = make(map[string]*Router)
+			}
+			c.HTTP.Routers[rename(k)] = nr
+		}
+		for _, m := range r.Middlewares {
+			if !isManaged(oid, m) && !nr.hasMiddleware(rename(m)) {
+				nr.Middlewares = append(nr.Middlewares, rename(m))
+			}
+		}
+	}
+	for k, s := range old.HTTP.Services {
+		if _, ok := c.HTTP.Services[rename(k)]; ok || isManagedService(oid, k) {
+			continue
+		}
+		ns := *s
+		ns.Weighted.Services = make([]weightedService, len(s.Weighted.Services))
+		for i, ws := range s.Weighted.Services {
+			ws.Name = rename(ws.Name)
+			ns.Weighted.Services[i] = ws
+		}
+		ns.Extra = renameRefs(s.Extra, rename).(map[string]interface{})
+		if c.HTTP.Services == nil {
+			c.HTTP.Services = make(map[string]*Service)
+		}
+		c.HTTP.Services[rename(k)] = &ns
+	}
+	for k, m := range old.HTTP.Middlewares {
+		if !isManaged(oid, k) {
+			if c.HTTP.Middlewares == nil {
+				c.HTTP.Middlewares = make(map[string]*Middleware)
+			}
+			nm := *m
+			nm.Extra = renameRefs(m.Extra, rename).(map[string]interface{})
+			c.HTTP.Middlewares[rename(k)] = &nm
+		}
+	}
+}
+
+// renamer returns a func which renames the entry id old and the names derived
+// from it, <old>-<suffix>, to new
+func renamer(old string, new string) func(string) string {
+	return func(k string) string {
+		if k == old || strings.HasPrefix(k, old+"-") {
+			return new + strings.TrimPrefix(k, old)
+		}
+		return k
+	}
+}
+
+// isManagedRouter returns true if the router is generated for the entry
+func isManagedRouter(id string, name string) bool {
+	return name == id || name == id+"-http"
+}
+
+// isManagedService returns true if the service is generated for the entry,
+// the backends of weighted entries are named <id>-<n>
+func isManagedService(id string, name string) bool {
+	if name == id {
+		return true
+	}
+	n := strings.TrimPrefix(name, id+"-")
+	_, err := strconv.Atoi(n)
+	return n != name && err == nil
+}
+
+// renameRefs returns a copy of the unmodelled value with all strings renamed,
+// these reference other routers, services or middlewares by name, e.g. the
+// service of an errors middleware or the middlewares of a chain
+func renameRefs(v interface{}, rename func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return rename(t)
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = renameRefs(e, rename)
+		}
+		return l
+	case map[string]interface{}:
+		if t == nil {
+			return t
+		}
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = renameRefs(e, rename)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for k, e := range t {
+			m[k] = renameRefs(e, rename)
+		}
+		return m
+	}
+	return v
+}
+
+// inheritExtra copies the Extra maps of src to the matching structs in dst,
+// map entries are matched by their renamed key and slices by index
+func inheritExtra(dst reflect.Value, src reflect.Value, rename func(string) string) {
+	switch src.Kind() {
+	case reflect.Ptr:
+		if !src.IsNil() && !dst.IsNil() {
+			inheritExtra(dst.Elem(), src.Elem(), rename)
+		}
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			f := src.Type().Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Name == "Extra" {
+				if dst.Field(i).Len() == 0 {
+					dst.Field(i).Set(reflect.ValueOf(renameRefs(src.Field(i).Interface(), rename)))
+				}
+				continue
+			}
+			inheritExtra(dst.Field(i), src.Field(i), rename)
+		}
+	case reflect.Map:
+		if src.Type().Key().Kind() != reflect.String || dst.IsNil() {
+			return
+		}
+		for _, k := range src.MapKeys() {
+			if d := dst.MapIndex(reflect.ValueOf(rename(k.String()))); d.IsValid() {
+				inheritExtra(d, src.MapIndex(k), rename)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < src.Len() && i < dst.Len(); i++ {
+			inheritExtra(dst.Index(i), src.Index(i), rename)
+		}
+	}
+}
+
+// ChangeIdentifier renames the entry from old to new. The routers, services
+// and middlewares named after the entry move along and so do all references
+// to them.
 func (c *Config) ChangeIdentifier(old string, new string) {
 	c.Load()
-	rKeys := c.RouterKeys()
-	for _, k := range rKeys {
-		c.HTTP.Routers[k].Service = new
-		if strings.HasPrefix(k, old) {
-			nn := strings.Replace(k, old, new, -1)
-			c.HTTP.Routers[nn] = c.HTTP.Routers[k]
-			delete(c.HTTP.Routers, k)
+	rename := renamer(old, new)
+	for _, r := range c.HTTP.Routers {
+		r.Service = rename(r.Service)
+		for i, m := range r.Middlewares {
+			r.Middlewares[i] = rename(m)
 		}
+		r.Extra = renameRefs(r.Extra, rename).(map[string]interface{})
 	}
-	c.HTTP.Services[new] = c.HTTP.Services[old]
-	delete(c.HTTP.Services, old)
+	for _, s := range c.HTTP.Services {
+		for i, ws := range s.Weighted.Services {
+			s.Weighted.Services[i].Name = rename(ws.Name)
+		}
+		s.Extra = renameRefs(s.Extra, rename).(map[string]interface{})
+	}
+	for _, m := range c.HTTP.Middlewares {
+		m.Extra = renameRefs(m.Extra, rename).(map[string]interface{})
+	}
+	for _, r := range c.TCP.Routers {
+		r.Service = rename(r.Service)
+	}
+	for _, r := range c.UDP.Routers {
+		r.Service = rename(r.Service)
+	}
+	renameKeys(c.HTTP.Routers, rename)
+	renameKeys(c.HTTP.Services, rename)
+	renameKeys(c.HTTP.Middlewares, rename)
+	renameKeys(c.TCP.Routers, rename)
+	renameKeys(c.TCP.Services, rename)
+	renameKeys(c.UDP.Routers, rename)
+	renameKeys(c.UDP.Services, rename)
 	c.Save()
 }
 
@@ -278,6 +724,29 @@ func (c *Config) RouterKeys() []string {
 	return keys
 }
 
+// renameKeys renames all keys of m
+func renameKeys[V any](m map[string]V, rename func(string) string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if nk := rename(k); nk != k {
+			v := m[k]
+			delete(m, k)
+			m[nk] = v
+		}
+	}
+}
+
+func (c *Config) ServiceKeys() []string {
+	var keys []string = make([]string, 0)
+	for k := range c.HTTP.Services {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 // Save serializes the config to file
 func (c *Config) Save() error {
 	var (
@@ -287,8 +756,22 @@ func (c *Config) Save() error {
 	if b, err = yaml.Marshal(c); err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(c.Path, b, 0644)
-	return err
+	// traefik watches the directory, never let it see a partially written file
+	if err = helpers.WriteFileAtomic(c.Path, b, 0644); err != nil {
+		return err
+	}
+	c.revision = revision(b)
+	return nil
+}
+
+// Revision identifies the content of the config file as it was loaded or saved
+func (c *Config) Revision() string {
+	return c.revision
+}
+
+func revision(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])[:16]
 }
 
 func spliceEmpty(slice []string) []string {
@@ -301,6 +784,16 @@ func spliceEmpty(slice []string) []string {
 	return o
 }
 
+// renameID returns the id of an entry after it got the given name, the hash
+// part of the id is kept so it stays unique
+func renameID(id string, name string) string {
+	p := strings.SplitN(id, "_", 2)
+	if len(p) < 2 || p[1] == "" {
+		return name + "_" + RandHash()
+	}
+	return name + "_" + p[1]
+}
+
 func RandHash() string {
 	var b []byte = make([]byte, 16)
 	rand.Read(b)
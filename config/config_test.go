@@ -5,7 +5,10 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 var sample1 Config = Config{
@@ -64,8 +67,10 @@ var sample1 Config = Config{
 var ui UserInput = UserInput{
 	Name:   "Test",
 	Domain: "test.example.com",
-	Backend: Backend{
-		URL: "http://1.2.3.4:80",
+	Backends: []Backend{
+		{
+			URL: "http://1.2.3.4:80",
+		},
 	},
 	ForwardAuth: true,
 	HTTPS:       true,
@@ -198,6 +203,16 @@ func TestSave(t *testing.T) {
 	if sample1.Save() != nil {
 		t.Error("Should return nil")
 	}
+
+	// no temp files are left behind
+	dir := t.TempDir()
+	sample1.Path = path.Join(dir, "Sample1_12345678.yaml")
+	if sample1.Save() != nil || sample1.Save() != nil {
+		t.Error("Should return nil")
+	}
+	if d, _ := os.ReadDir(dir); len(d) != 1 {
+		t.Errorf("Should only contain the config, got %d files", len(d))
+	}
 }
 
 func TestChangeIdentifier(t *testing.T) {
@@ -222,6 +237,209 @@ func TestFromUserInput(t *testing.T) {
 	}
 }
 
+func TestBasicAuthHashes(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	u := UserInput{
+		Name:      "Test",
+		Domain:    "test.example.com",
+		HTTPS:     true,
+		Backends:  []Backend{{URL: "http://1.2.3.4:80"}},
+		BasicAuth: []basicAuthInput{{Username: "user", Password: string(hash)}},
+	}
+	users := func() string {
+		c := FromUserInput(&u, "http01")
+		return c.HTTP.Middlewares[c.id+"-basicauth"].BasicAuth.Users[0]
+	}
+	stored := strings.TrimPrefix(users(), "user:")
+	if stored == string(hash) || bcrypt.CompareHashAndPassword([]byte(stored), hash) != nil {
+		t.Errorf("A submitted hash should be hashed like any password")
+	}
+	u.hashedPasswords = true
+	if users() != "user:"+string(hash) {
+		t.Errorf("Imported hashes should be kept")
+	}
+}
+
+func TestWeightedBackends(t *testing.T) {
+	u := UserInput{
+		Name:   "Test",
+		Domain: "test.example.com",
+		Backends: []Backend{
+			{URL: "http://1.2.3.4:80", Weight: 3},
+			{URL: "http://1.2.3.5:80"},
+			{},
+		},
+	}
+	c := FromUserInput(&u, "http01")
+	if c == nil {
+		t.Fatal("Should be non nil")
+	}
+	if len(c.HTTP.Services[c.id].Weighted.Services) != 2 {
+		t.Fatalf("Should have a weighted service with 2 children")
+	}
+	b := c.HTTP.backends(c.id)
+	if !reflect.DeepEqual(b, []Backend{{URL: "http://1.2.3.4:80", Weight: 3}, {URL: "http://1.2.3.5:80", Weight: 1}}) {
+		t.Errorf("Wrong backends %v", b)
+	}
+
+	u.Backends[0].Weight = 0
+	c = FromUserInput(&u, "http01")
+	if len(c.HTTP.Services) != 1 || len(c.HTTP.Services[c.id].LoadBalancer.Servers) != 2 {
+		t.Errorf("Should have a single load balancer with 2 servers")
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	p := &pathRewrite{
+		StripPrefix:      []string{"/grafana", ""},
+		StripPrefixRegex: []string{"/users/[0-9]+"},
+		AddPrefix:        "/app",
+		ReplacePath:      "/foo",
+		ReplacePathRegex: replacePathRegex{Regex: "^/api/(.*)", Replacement: "/v1/$1"},
+	}
+	c, err := M.Add(&UserInput{
+		Name:        "Test",
+		Domain:      "test.example.com",
+		Backends:    []Backend{{URL: "http://1.2.3.4:80"}},
+		HTTPS:       true,
+		PathRewrite: p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.HTTP.Routers[c.id].Middlewares, []string{
+		c.id + "-stripprefix", c.id + "-stripprefixregex", c.id + "-addprefix", c.id + "-replacepath", c.id + "-replacepathregex",
+	}) {
+		t.Errorf("Wrong middlewares %v", c.HTTP.Routers[c.id].Middlewares)
+	}
+	u, err := M.Get(c.id).ToUserInput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.StripPrefix = []string{"/grafana"}
+	if !reflect.DeepEqual(u.PathRewrite, p) {
+		t.Errorf("Wrong path rewrite %+v", u.PathRewrite)
+	}
+
+	p.StripPrefixRegex = []string{"[a-"}
+	p.AddPrefix = "app"
+	p.ReplacePathRegex.Replacement = ""
+	u.PathRewrite = p
+	v := u.Validate()
+	if v.Valid || v.Errors.PathRewrite.StripPrefixRegex == "" || v.Errors.PathRewrite.AddPrefix == "" || v.Errors.PathRewrite.ReplacePathRegex == "" {
+		t.Errorf("Should be invalid %+v", v.Errors.PathRewrite)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	u := &UserInput{
+		Name:      "Test",
+		Domain:    "test.example.com",
+		Backends:  []Backend{{URL: "http://1.2.3.4:80"}},
+		HTTPS:     true,
+		RateLimit: &rateLimit{Average: 100, Burst: 50, Period: "1m", SourceCriterion: sourceCriterion{Depth: 1}},
+		InFlight:  &inFlight{Amount: 10, SourceCriterion: sourceCriterion{Header: "X-Real-IP"}},
+	}
+	c, err := M.Add(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range c.HTTP.Routers {
+		if !r.hasMiddleware(c.id+"-ratelimit") || !r.hasMiddleware(c.id+"-inflight") {
+			t.Errorf("Router should have ratelimit and inflight middlewares")
+		}
+	}
+	got, err := M.Get(c.id).ToUserInput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.RateLimit, u.RateLimit) || !reflect.DeepEqual(got.InFlight, u.InFlight) {
+		t.Errorf("Wrong limits %+v %+v", got.RateLimit, got.InFlight)
+	}
+
+	u.RateLimit = &rateLimit{Average: -1, Period: "often", SourceCriterion: sourceCriterion{Depth: 1, Host: true}}
+	u.InFlight = &inFlight{Amount: 10001, SourceCriterion: sourceCriterion{Header: "X Real IP"}}
+	v := u.Validate()
+	if v.Valid || v.Errors.RateLimit.Average == "" || v.Errors.RateLimit.Period == "" || v.Errors.RateLimit.SourceCriterion == "" ||
+		v.Errors.InFlight.Amount == "" || v.Errors.InFlight.SourceCriterion == "" {
+		t.Errorf("Should be invalid %+v %+v", v.Errors.RateLimit, v.Errors.InFlight)
+	}
+}
+
+func TestLoadBalancerOptions(t *testing.T) {
+	passHostHeader := false
+	in := &loadBalancerInput{
+		PassHostHeader: &passHostHeader,
+		HealthCheck: healthCheckInput{
+			Path:     "/health",
+			Interval: "10s",
+			Timeout:  "3s",
+			Scheme:   "http",
+			Headers:  []headersInput{{Name: "Host", Value: "test.example.com"}, {}, {}, {}, {}},
+		},
+		Sticky: stickyInput{Enabled: true, Name: "srv", Secure: true, HTTPOnly: true, SameSite: "lax"},
+	}
+	u := UserInput{
+		Name:         "Test",
+		Domain:       "test.example.com",
+		Backends:     []Backend{{URL: "http://1.2.3.4:80"}, {URL: "http://1.2.3.5:80"}},
+		LoadBalancer: in,
+	}
+	c := FromUserInput(&u, "http01")
+	lb := c.HTTP.Services[c.id].LoadBalancer
+	if lb.HealthCheck == nil || lb.Sticky == nil || lb.PassHostHeader == nil {
+		t.Fatal("Load balancer options missing")
+	}
+	if !reflect.DeepEqual(c.HTTP.loadBalancerInput(c.id), in) {
+		t.Errorf("Wrong load balancer options %+v", c.HTTP.loadBalancerInput(c.id))
+	}
+
+	// weighted services carry the sticky cookie on the weighted service
+	u.Backends[0].Weight = 2
+	c = FromUserInput(&u, "http01")
+	if c.HTTP.Services[c.id].Weighted.Sticky == nil || c.HTTP.Services[c.id+"-0"].LoadBalancer.Sticky != nil {
+		t.Error("Sticky cookie should be on the weighted service")
+	}
+	if c.HTTP.Services[c.id+"-1"].LoadBalancer.HealthCheck == nil {
+		t.Error("Health check should be on the child services")
+	}
+	if !reflect.DeepEqual(c.HTTP.loadBalancerInput(c.id), in) {
+		t.Errorf("Wrong load balancer options %+v", c.HTTP.loadBalancerInput(c.id))
+	}
+
+	// all headers survive in a stable order
+	in.HealthCheck.Headers = []headersInput{}
+	for _, n := range []string{"G", "C", "A", "F", "B", "E", "D"} {
+		in.HealthCheck.Headers = append(in.HealthCheck.Headers, headersInput{Name: "X-" + n, Value: n})
+	}
+	c = FromUserInput(&u, "http01")
+	hl := c.HTTP.loadBalancerInput(c.id).HealthCheck.Headers
+	if len(hl) != 7 || hl[0].Name != "X-A" || hl[6].Name != "X-G" || hl[6].Value != "G" {
+		t.Errorf("Health check headers lost or unsorted %+v", hl)
+	}
+
+	in.HealthCheck.Path = "health"
+	in.HealthCheck.Interval = "10"
+	in.Sticky.SameSite = "always"
+	v := u.Validate()
+	if v.Valid || v.Errors.HealthCheck.Path == "" || v.Errors.HealthCheck.Interval == "" || v.Errors.Sticky.SameSite == "" {
+		t.Errorf("Should be invalid %+v %+v", v.Errors.HealthCheck, v.Errors.Sticky)
+	}
+
+	in.HealthCheck.Path = ""
+	in.HealthCheck.Interval = ""
+	in.Sticky.SameSite = "lax"
+	if v = u.Validate(); v.Valid || v.Errors.HealthCheck.Headers == "" {
+		t.Errorf("Headers without path should be invalid %+v", v.Errors.HealthCheck)
+	}
+	in.HealthCheck.Headers = []headersInput{{}, {}}
+	if v = u.Validate(); !v.Valid {
+		t.Errorf("Empty header rows without path should be valid %+v", v.Errors.HealthCheck)
+	}
+}
+
 func TestRandHash(t *testing.T) {
 	if RandHash() == "" {
 		t.Error("Should return a string")
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pheelee/traefik-admin/logger"
+)
+
+// DefaultAuthor is used for commits of changes without a logged in identity
+const DefaultAuthor = "traefik-admin"
+
+// As returns a copy of the manager which commits its changes in the name of author
+func (m ConfigManager) As(author string) *ConfigManager {
+	m.author = author
+	return &m
+}
+
+// InitGit makes the config path a git working tree if it is not part of one
+// yet and commits changes made outside of traefik-admin
+func (m *ConfigManager) InitGit() error {
+	if !m.Git {
+		return nil
+	}
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	_, err := git.PlainOpenWithOptions(m.Path, &git.PlainOpenOptions{DetectDotGit: true})
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		_, err = git.PlainInit(m.Path, false)
+	}
+	if err != nil {
+		return err
+	}
+	return m.commit("Sync config directory")
+}
+
+// commit records all changes below the config path, nothing is committed if
+// git is disabled or the directory is unchanged
+func (m *ConfigManager) commit(msg string) error {
+	if !m.Git {
+		return nil
+	}
+	r, err := git.PlainOpenWithOptions(m.Path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(m.Path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(w.Filesystem.Root(), abs)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Add(rel); err != nil {
+		return err
+	}
+	st, err := w.Status()
+	if err != nil {
+		return err
+	}
+	staged := false
+	for _, s := range st {
+		if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+			staged = true
+		}
+	}
+	if !staged {
+		return nil
+	}
+	author := m.author
+	if author == "" {
+		author = DefaultAuthor
+	}
+	_, err = w.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{Name: author, When: time.Now()},
+	})
+	return err
+}
+
+// commitf commits the changes and logs failures, the change itself is
+// already written at this point and must not be reported as failed
+func (m *ConfigManager) commitf(format string, a ...interface{}) {
+	if err := m.commit(fmt.Sprintf(format, a...)); err != nil {
+		logger.Error(fmt.Sprintf("git commit failed: %s", err))
+	}
+}
+
+// commitUpdate commits an updated entry which was named old before
+func (m *ConfigManager) commitUpdate(old string, c *Config) {
+	if old == c.ID() {
+		m.commitf("Update %s", old)
+		return
+	}
+	m.commitf("Rename %s to %s", old, c.ID())
+}
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pheelee/traefik-admin/helpers"
+	"gopkg.in/yaml.v2"
+)
+
+// ErrHistoryDisabled is returned by the history functions if no history path is configured
+var ErrHistoryDisabled = errors.New("history is disabled")
+
+// validID returns true if id is a plain entry name which can't leave the
+// history directory
+func validID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\*?[`)
+}
+
+// Version is a previous or the current content of an entry
+type Version struct {
+	Entry    string    `json:"entry"`
+	Revision string    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Current  bool      `json:"current"`
+	Deleted  bool      `json:"deleted"`
+}
+
+// historyDir returns the directory holding the versions of the entry
+func (m *ConfigManager) historyDir(id string) string {
+	return path.Join(m.HistoryPath, id)
+}
+
+// record stores the current content of the config file in the history unless
+// this revision is already known
+func (m *ConfigManager) record(c *Config) error {
+	if m.HistoryPath == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(c.Path)
+	if err != nil {
+		return err
+	}
+	dir := m.historyDir(c.ID())
+	rev := revision(b)
+	if known, _ := filepath.Glob(path.Join(dir, "*_"+rev+"_*.yaml")); len(known) > 0 {
+		return nil
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// the id is kept in the name because the history moves along when the entry is renamed
+	name := fmt.Sprintf("%019d_%s_%s.yaml", time.Now().UnixNano(), rev, c.ID())
+	return helpers.WriteFileAtomic(path.Join(dir, name), b, 0644)
+}
+
+// moveHistory keeps the history of an entry when its id changes
+func (m *ConfigManager) moveHistory(old string, new string) error {
+	if m.HistoryPath == "" || old == new {
+		return nil
+	}
+	if _, err := os.Stat(m.historyDir(old)); os.IsNotExist(err) {
+		return nil
+	}
+	return os.Rename(m.historyDir(old), m.historyDir(new))
+}
+
+// History returns all known versions of the entry, newest first
+func (m *ConfigManager) History(id string) ([]Version, error) {
+	if m.HistoryPath == "" {
+		return nil, ErrHistoryDisabled
+	}
+	if !validID(id) {
+		return nil, fmt.Errorf("invalid entry %s", id)
+	}
+	fi, err := ioutil.ReadDir(m.historyDir(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no history for %s", id)
+		}
+		return nil, err
+	}
+	current := ""
+	if c := m.Get(id); c != nil {
+		current = c.Revision()
+	}
+	vl := []Version{}
+	for _, f := range fi {
+		p := strings.SplitN(strings.TrimSuffix(f.Name(), ".yaml"), "_", 3)
+		if len(p) != 3 || path.Ext(f.Name()) != ".yaml" {
+			continue
+		}
+		ns, err := strconv.ParseInt(p[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		vl = append(vl, Version{
+			Entry:    id,
+			Revision: p[1],
+			Time:     time.Unix(0, ns),
+			Current:  p[1] == current,
+			Deleted:  current == "",
+		})
+	}
+	sort.Slice(vl, func(i, j int) bool { return vl[i].Time.After(vl[j].Time) })
+	return vl, nil
+}
+
+// VersionContent returns the file content of the given revision of the entry
+func (m *ConfigManager) VersionContent(id string, rev string) ([]byte, error) {
+	b, _, err := m.version(id, rev)
+	return b, err
+}
+
+// version returns the content of the revision and the id the entry had at that time
+func (m *ConfigManager) version(id string, rev string) ([]byte, string, error) {
+	if m.HistoryPath == "" {
+		return nil, "", ErrHistoryDisabled
+	}
+	if !validID(id) {
+		return nil, "", fmt.Errorf("invalid entry %s", id)
+	}
+	if !validID(rev) || strings.Contains(rev, "_") {
+		return nil, "", fmt.Errorf("invalid revision")
+	}
+	f, _ := filepath.Glob(path.Join(m.historyDir(id), "*_"+rev+"_*.yaml"))
+	if len(f) == 0 {
+		return nil, "", fmt.Errorf("revision %s of %s not found", rev, id)
+	}
+	b, err := ioutil.ReadFile(f[0])
+	if err != nil {
+		return nil, "", err
+	}
+	p := strings.SplitN(strings.TrimSuffix(path.Base(f[0]), ".yaml"), "_", 3)
+	return b, p[2], nil
+}
+
+// Diff returns a line diff between two revisions of the entry, an empty to
+// compares against the current content
+func (m *ConfigManager) Diff(id string, from string, to string) (string, error) {
+	a, err := m.VersionContent(id, from)
+	if err != nil {
+		return "", err
+	}
+	var b []byte
+	if to == "" {
+		c := m.Get(id)
+		if c == nil {
+			return "", ErrNotFound
+		}
+		to = c.Revision()
+		b, err = ioutil.ReadFile(c.Path)
+	} else {
+		b, err = m.VersionContent(id, to)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("--- %s\n+++ %s\n", from, to) + diffLines(string(a), string(b)), nil
+}
+
+// Restore makes the given revision the current content of the entry, this
+// also brings back deleted entries. The entry keeps its current id even if the
+// revision was saved under a different name, so it keeps its access policy as
+// well. Deleted entries come back without one.
+func (m *ConfigManager) Restore(id string, rev string) (c *Config, err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("restore", err) }()
+	b, vid, err := m.version(id, rev)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.checkVersion(id, vid, b); err != nil {
+		return nil, err
+	}
+	if c := m.Get(id); c != nil {
+		if err = m.record(c); err != nil {
+			return nil, err
+		}
+	}
+	c = &Config{Path: path.Join(m.Path, id+".yaml")}
+	if err = helpers.WriteFileAtomic(c.Path, b, 0644); err != nil {
+		return nil, err
+	}
+	if vid != id {
+		c.ChangeIdentifier(vid, id)
+	}
+	m.invalidate(id)
+	if err = c.Load(); err != nil {
+		return nil, err
+	}
+	if err = m.record(c); err != nil {
+		return nil, err
+	}
+	m.commitf("Restore %s to %s", id, rev)
+	return c, nil
+}
+
+// checkVersion returns a *DomainConflict if the http entry in b, saved as vid,
+// matches the same requests as an entry other than id
+func (m *ConfigManager) checkVersion(id string, vid string, b []byte) error {
+	c := &Config{Path: path.Join(m.Path, vid+".yaml"), loaded: true}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return err
+	}
+	if c.Protocol() != "" {
+		return nil
+	}
+	u, err := c.ToUserInput()
+	if err != nil {
+		return err
+	}
+	return m.checkDomain(u, id)
+}
+
+// Deleted returns the latest version of all entries which only exist in the history
+func (m *ConfigManager) Deleted() ([]Version, error) {
+	if m.HistoryPath == "" {
+		return nil, ErrHistoryDisabled
+	}
+	fi, err := ioutil.ReadDir(m.HistoryPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Version{}, nil
+		}
+		return nil, err
+	}
+	vl := []Version{}
+	for _, f := range fi {
+		if !f.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(path.Join(m.Path, f.Name()+".yaml")); err == nil {
+			continue
+		}
+		h, err := m.History(f.Name())
+		if err != nil || len(h) == 0 {
+			continue
+		}
+		vl = append(vl, h[0])
+	}
+	return vl, nil
+}
+
+// diffLines returns the lines of a and b prefixed by "-", "+" or " " based on
+// their longest common subsequence
+func diffLines(a string, b string) string {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			sb.WriteString(" " + x[i] + "\n")
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString("-" + x[i] + "\n")
+			i++
+		default:
+			sb.WriteString("+" + y[j] + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -1,18 +1,55 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 var Manager ConfigManager
 
+// ErrNotFound is returned if the entry to change does not exist
+var ErrNotFound = errors.New("config not found")
+
+// ErrConflict is returned if an entry was modified since the revision the
+// change is based on
+var ErrConflict = errors.New("config was modified in the meantime")
+
+// DomainConflict is returned if another entry already matches the same requests
+type DomainConflict struct {
+	Entry string
+	Name  string
+	Host  string
+}
+
+func (e *DomainConflict) Error() string {
+	return fmt.Sprintf("%s is already used by %s", e.Host, e.Name)
+}
+
+// writeLock serializes all modifications of the config files
+var writeLock sync.Mutex
+
 type ConfigManager struct {
 	Path         string
 	CertResolver string
+	// HistoryPath holds the previous versions of every entry, it must not be
+	// watched by traefik. History is disabled if empty.
+	HistoryPath string
+	// AccessPath is the file holding the forward auth policies, it must not be
+	// watched by traefik. Policies are not stored if empty.
+	AccessPath string
+	// Git commits every change if Path is part of a git working tree
+	Git bool
+	// OnWriteFailure is called with the operation whenever writing the files
+	// failed, conflicts and invalid input are not reported
+	OnWriteFailure func(operation string)
+	author         string
+	index          *index
 }
 
 type Operation int
@@ -22,34 +59,219 @@ const (
 	Remove
 )
 
-func (m *ConfigManager) Add(u *UserInput) (*Config, error) {
+func (m *ConfigManager) Add(u *UserInput) (c *Config, err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("save", err) }()
+	if err := m.checkDomain(u, ""); err != nil {
+		return nil, err
+	}
 	// Generate Config
-	c := FromUserInput(u, m.CertResolver)
+	c = FromUserInput(u, m.CertResolver)
 	if c == nil {
 		return nil, fmt.Errorf("invalid userinput")
 	}
+	// the policy is stored first so the entry is never reachable without it
+	undo, err := m.setAccessPolicy("", c.id, u.AccessPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.create(c); err != nil {
+		undo()
+		return nil, err
+	}
+	m.commitf("Add %s", c.ID())
+	return c, nil
+}
+
+// AddStream writes a new tcp or udp entry
+func (m *ConfigManager) AddStream(s *StreamInput) (c *Config, err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("save", err) }()
+	c = FromStreamInput(s, m.CertResolver)
+	if c == nil {
+		return nil, fmt.Errorf("invalid stream input")
+	}
+	if _, err := m.create(c); err != nil {
+		return nil, err
+	}
+	m.commitf("Add %s", c.ID())
+	return c, nil
+}
+
+func (m *ConfigManager) create(c *Config) (*Config, error) {
 	// Set Path
 	c.Path = path.Join(m.Path, c.id+".yaml")
 	if err := c.Save(); err != nil {
 		return nil, err
 	}
+	m.invalidate(c.id)
+	return c, m.record(c)
+}
+
+//Update rewrites the config with the id of the input in place, the id only
+//changes if the name changed. If the input carries a revision the update fails
+//with ErrConflict unless it matches the current one.
+func (m *ConfigManager) Update(u *UserInput) (c *Config, err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("save", err) }()
+	old, err := m.current(u.ID, u.Revision)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.checkDomain(u, old.ID()); err != nil {
+		return nil, err
+	}
+	c = fromUserInput(u, m.CertResolver, renameID(old.ID(), u.Name))
+	if c == nil {
+		return nil, fmt.Errorf("invalid userinput")
+	}
+	undo, err := m.setAccessPolicy(old.ID(), c.id, u.AccessPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = m.replace(old, c); err != nil {
+		undo()
+		return nil, err
+	}
+	m.commitUpdate(old.ID(), c)
 	return c, nil
 }
 
-//Update must search a config by hash, delete it and write the new config to file
-func (m *ConfigManager) Update(u *UserInput) (*Config, error) {
-	if err := m.Delete(u.ID); err != nil {
+//UpdateStream rewrites the tcp or udp entry with the id of the input in place
+func (m *ConfigManager) UpdateStream(s *StreamInput) (c *Config, err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("save", err) }()
+	old, err := m.current(s.ID, s.Revision)
+	if err != nil {
 		return nil, err
 	}
-	return m.Add(u)
+	c = fromStreamInput(s, m.CertResolver, renameID(old.ID(), s.Name))
+	if c == nil {
+		return nil, fmt.Errorf("invalid stream input")
+	}
+	if _, err = m.replace(old, c); err != nil {
+		return nil, err
+	}
+	m.commitUpdate(old.ID(), c)
+	return c, nil
+}
+
+// checkDomain returns a *DomainConflict if an http entry other than self
+// matches the same requests as u
+func (m *ConfigManager) checkDomain(u *UserInput, self string) error {
+	ul, err := m.ListUserInputs()
+	if err != nil {
+		return err
+	}
+	for _, o := range ul {
+		if o.ID == self {
+			continue
+		}
+		if h := u.rule().conflicts(o.rule()); h != "" {
+			return &DomainConflict{Entry: o.ID, Name: o.Name, Host: h}
+		}
+	}
+	return nil
+}
+
+// replace writes the config in place of old keeping the settings of old which
+// are not managed by traefik-admin. The new file is written before the old one
+// is removed so a failure never loses the entry.
+func (m *ConfigManager) replace(old *Config, c *Config) (*Config, error) {
+	c.inherit(old)
+	if err := m.record(old); err != nil {
+		return nil, err
+	}
+	if err := m.moveHistory(old.ID(), c.id); err != nil {
+		return nil, err
+	}
+	if _, err := m.create(c); err != nil {
+		m.moveHistory(c.id, old.ID())
+		return nil, err
+	}
+	if c.Path == old.Path {
+		return c, nil
+	}
+	defer m.invalidate(old.ID())
+	if err := os.Remove(old.Path); err != nil {
+		os.Remove(c.Path)
+		m.moveHistory(c.id, old.ID())
+		return nil, err
+	}
+	return c, nil
+}
+
+// save writes the modified config and keeps the previous and the new content
+// in the history
+func (m *ConfigManager) save(c *Config) error {
+	if err := m.record(c); err != nil {
+		return err
+	}
+	if err := c.Save(); err != nil {
+		return err
+	}
+	m.invalidate(c.ID())
+	return m.record(c)
+}
+
+// Delete removes the entry, the revision is checked like in Update
+func (m *ConfigManager) Delete(id string, revision string) (err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("delete", err) }()
+	c, err := m.current(id, revision)
+	if err != nil {
+		return err
+	}
+	if err = m.remove(c); err != nil {
+		return err
+	}
+	if _, err = m.setAccessPolicy(id, "", nil); err != nil {
+		return err
+	}
+	m.commitf("Delete %s", id)
+	return nil
 }
 
-func (m *ConfigManager) Delete(id string) error {
+// remove deletes the config file after keeping its content in the history
+func (m *ConfigManager) remove(c *Config) error {
+	if err := m.record(c); err != nil {
+		return err
+	}
+	defer m.invalidate(c.ID())
+	return os.Remove(c.Path)
+}
+
+// current returns the entry with the given id, if revision is not empty it has
+// to match the revision of the entry
+func (m *ConfigManager) current(id string, revision string) (*Config, error) {
 	c := m.Get(id)
 	if c == nil {
-		return fmt.Errorf("config not found")
+		return nil, ErrNotFound
+	}
+	if revision != "" && revision != c.Revision() {
+		return nil, ErrConflict
+	}
+	return c, nil
+}
+
+// observeWrite reports err to OnWriteFailure if the filesystem failed
+func (m *ConfigManager) observeWrite(operation string, err error) {
+	if m.OnWriteFailure == nil || err == nil {
+		return
+	}
+	var (
+		pe *fs.PathError
+		le *os.LinkError
+		se *os.SyscallError
+	)
+	if errors.As(err, &pe) || errors.As(err, &le) || errors.As(err, &se) {
+		m.OnWriteFailure(operation)
 	}
-	return os.Remove(c.Path)
 }
 
 func (m *ConfigManager) Get(id string) *Config {
@@ -70,21 +292,44 @@ func (m *ConfigManager) Get(id string) *Config {
 
 func (m *ConfigManager) List() ([]Config, error) {
 	var (
-		cl  []Config = make([]Config, 0)
-		err error
-		fi  []os.FileInfo
+		cl    []Config = make([]Config, 0)
+		err   error
+		files []string
 	)
 
-	if fi, err = ioutil.ReadDir(m.Path); err != nil {
+	if m.index != nil {
+		m.index.Lock()
+		if m.index.files == nil {
+			m.index.files, err = m.readDir()
+		}
+		files = m.index.files
+		m.index.Unlock()
+	} else {
+		files, err = m.readDir()
+	}
+	if err != nil {
 		return nil, err
 	}
 
+	for _, f := range files {
+		cl = append(cl, Config{Path: path.Join(m.Path, f)})
+	}
+	return cl, nil
+}
+
+// readDir returns the file names of all entries in the config path
+func (m *ConfigManager) readDir() ([]string, error) {
+	fi, err := ioutil.ReadDir(m.Path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
 	for _, f := range fi {
-		if path.Ext(f.Name()) == ".yaml" && !strings.HasPrefix(f.Name(), "sys_") {
-			cl = append(cl, Config{Path: path.Join(m.Path, f.Name())})
+		if isEntryFile(f.Name()) {
+			files = append(files, f.Name())
 		}
 	}
-	return cl, nil
+	return files, nil
 }
 
 func (m *ConfigManager) ListUserInputs() ([]UserInput, error) {
@@ -94,35 +339,89 @@ func (m *ConfigManager) ListUserInputs() ([]UserInput, error) {
 		return uil, err
 	}
 	for _, c := range cl {
+		if err := m.load(&c); err != nil {
+			return uil, err
+		}
+		if c.Protocol() != "" {
+			continue
+		}
 		u, err := c.ToUserInput()
 		if err != nil {
 			return uil, err
 		}
+		if err = m.LoadAccessPolicy(u); err != nil {
+			return uil, err
+		}
 		uil = append(uil, *u)
 	}
 	return uil, nil
 }
 
-func (m *ConfigManager) SetCertResolver(r string) error {
+// ListStreamInputs returns all tcp and udp entries
+func (m *ConfigManager) ListStreamInputs() ([]StreamInput, error) {
+	sil := []StreamInput{}
+	cl, err := m.List()
+	if err != nil {
+		return sil, err
+	}
+	for _, c := range cl {
+		if err := m.load(&c); err != nil {
+			return sil, err
+		}
+		if c.Protocol() == "" {
+			continue
+		}
+		s, err := c.ToStreamInput()
+		if err != nil {
+			return sil, err
+		}
+		sil = append(sil, *s)
+	}
+	return sil, nil
+}
+
+// SetCertResolver changes the cert resolver of all tls routers, every entry is
+// saved once no matter how many routers it has
+func (m *ConfigManager) SetCertResolver(r string) (err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("certresolver", err) }()
 	cl, err := m.List()
 	if err != nil {
 		return err
 	}
 	for _, c := range cl {
-		c.Load()
-		for k, e := range c.HTTP.Routers {
-			if e.TLS != nil {
-				c.HTTP.Routers[k].TLS.CertResolver = r
-				if err := c.Save(); err != nil {
-					return err
-				}
+		if err := c.Load(); err != nil {
+			return err
+		}
+		changed := false
+		for _, e := range c.HTTP.Routers {
+			if e.TLS != nil && e.TLS.CertResolver != r {
+				e.TLS.CertResolver = r
+				changed = true
+			}
+		}
+		for _, e := range c.TCP.Routers {
+			if e.TLS != nil && e.TLS.CertResolver != "" && e.TLS.CertResolver != r {
+				e.TLS.CertResolver = r
+				changed = true
 			}
 		}
+		if !changed {
+			continue
+		}
+		if err := m.save(&c); err != nil {
+			return err
+		}
 	}
+	m.commitf("Set cert resolver %s", r)
 	return nil
 }
 
-func (m *ConfigManager) SetForwardAuth(o Operation) error {
+func (m *ConfigManager) SetForwardAuth(o Operation) (err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("forwardauth", err) }()
 	cl, err := m.List()
 	if err != nil {
 		return err
@@ -137,18 +436,23 @@ func (m *ConfigManager) SetForwardAuth(o Operation) error {
 				r.Middlewares = splice(r.Middlewares, FORWARDAUTH)
 			}
 		}
-		if err := c.Save(); err != nil {
+		if err := m.save(&c); err != nil {
 			return err
 		}
 	}
+	m.commitf("Update forward auth of all entries")
 	return nil
 }
 
-func (m *ConfigManager) MigrateConfig() error {
+func (m *ConfigManager) MigrateConfig() (err error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	defer func() { m.observeWrite("migrate", err) }()
 	cl, err := m.List()
 	if err != nil {
 		return err
 	}
+	defer m.invalidate()
 	for _, c := range cl {
 		id := c.ID()
 		p := strings.Split(id, "_")
@@ -163,6 +467,7 @@ func (m *ConfigManager) MigrateConfig() error {
 			}
 		}
 	}
+	m.commitf("Migrate config ids")
 	return nil
 }
 
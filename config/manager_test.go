@@ -1,11 +1,16 @@
 package config
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
 )
 
 var oldConfig string = `
@@ -35,20 +40,22 @@ http:
 
 func setupError(t *testing.T) ConfigManager {
 	M := ConfigManager{Path: "/roiwjegoijwerg", CertResolver: "http01"}
+	ui.Name, ui.Domain = "Test", "test.example.com"
 	M.Add(&ui)
-	ui.Name = "Test2"
+	ui.Name, ui.Domain = "Test2", "test2.example.com"
 	M.Add(&ui)
-	ui.Name = "Test3"
+	ui.Name, ui.Domain = "Test3", "test3.example.com"
 	M.Add(&ui)
 	return M
 }
 
 func setupSuccess(t *testing.T) ConfigManager {
 	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	ui.Name, ui.Domain = "Test", "test.example.com"
 	M.Add(&ui)
-	ui.Name = "Test2"
+	ui.Name, ui.Domain = "Test2", "test2.example.com"
 	M.Add(&ui)
-	ui.Name = "Test3"
+	ui.Name, ui.Domain = "Test3", "test3.example.com"
 	M.Add(&ui)
 	return M
 }
@@ -94,6 +101,263 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestUpdateKeepsID(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	c, _ := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	id := c.ID()
+	u, _ := M.Get(id).ToUserInput()
+	u.Backends = []Backend{{URL: "http://1.2.3.5:80"}}
+	if c, _ = M.Update(u); c == nil || c.ID() != id {
+		t.Fatal("ID should not change")
+	}
+	u.Name = "Renamed"
+	u.Revision = c.Revision()
+	if c, _ = M.Update(u); c == nil || c.ID() != "Renamed"+strings.TrimPrefix(id, "Test") {
+		t.Fatal("Only the name part of the ID should change")
+	}
+	if cl, _ := M.List(); len(cl) != 1 || cl[0].ID() != c.ID() {
+		t.Error("Should contain the renamed config only")
+	}
+}
+
+func TestRevisionConflict(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	c, _ := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	first, _ := M.Get(c.ID()).ToUserInput()
+	second, _ := M.Get(c.ID()).ToUserInput()
+	if first.Revision == "" || first.Revision != c.Revision() {
+		t.Fatal("Revision should be set")
+	}
+	first.Backends = []Backend{{URL: "http://1.2.3.5:80"}}
+	if _, err := M.Update(first); err != nil {
+		t.Fatal(err)
+	}
+	second.ForceTLS = true
+	if _, err := M.Update(second); err != ErrConflict {
+		t.Errorf("Should conflict, got %v", err)
+	}
+	if err := M.Delete(c.ID(), second.Revision); err != ErrConflict {
+		t.Errorf("Should conflict, got %v", err)
+	}
+	second.Revision = ""
+	if _, err := M.Update(second); err != nil {
+		t.Errorf("Update without revision should pass, got %v", err)
+	}
+	if err := M.Delete(c.ID(), M.Get(c.ID()).Revision()); err != nil {
+		t.Errorf("Should be deleted, got %v", err)
+	}
+}
+
+func TestDomainConflict(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	c, err := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := &UserInput{Name: "Other", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.5:80"}}}
+	_, err = M.Add(dup)
+	if dc, ok := err.(*DomainConflict); !ok || dc.Entry != c.ID() || dc.Host != "test.example.com" {
+		t.Fatalf("Should conflict with %s, got %v", c.ID(), err)
+	}
+	dup.Rule.PathPrefix = []string{"/api"}
+	if _, err = M.Add(dup); err != nil {
+		t.Fatalf("Different paths should not conflict %v", err)
+	}
+	u, _ := M.Get(c.ID()).ToUserInput()
+	u.Name = "Renamed"
+	if _, err = M.Update(u); err != nil {
+		t.Errorf("Update should not conflict with itself %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	temp := t.TempDir()
+	M := ConfigManager{Path: path.Join(temp, "dynamic"), CertResolver: "http01", HistoryPath: path.Join(temp, "history")}
+	os.Mkdir(M.Path, 0755)
+	c, err := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.Revision()
+	u, _ := M.Get(c.ID()).ToUserInput()
+	u.Name = "Renamed"
+	u.Backends = []Backend{{URL: "http://1.2.3.5:80"}}
+	if c, err = M.Update(u); err != nil {
+		t.Fatal(err)
+	}
+	h, err := M.History(c.ID())
+	if err != nil || len(h) != 2 || !h[0].Current || h[1].Revision != first {
+		t.Fatalf("Should keep both versions after rename %+v %v", h, err)
+	}
+	d, err := M.Diff(c.ID(), first, "")
+	if err != nil || !strings.Contains(d, "-        - url: http://1.2.3.4:80\n+        - url: http://1.2.3.5:80") {
+		t.Errorf("Wrong diff %s %v", d, err)
+	}
+
+	if err = M.Delete(c.ID(), ""); err != nil {
+		t.Fatal(err)
+	}
+	dl, err := M.Deleted()
+	if err != nil || len(dl) != 1 || dl[0].Entry != c.ID() || !dl[0].Deleted {
+		t.Fatalf("Should list the deleted entry %+v %v", dl, err)
+	}
+	if c, err = M.Restore(c.ID(), first); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ = c.ToUserInput(); u.Name != "Renamed" || u.Backends[0].URL != "http://1.2.3.4:80" {
+		t.Errorf("Wrong restore %+v", u)
+	}
+	if dl, _ = M.Deleted(); len(dl) != 0 {
+		t.Error("Restored entry should not be deleted")
+	}
+	if _, err = M.Restore(c.ID(), "../../etc"); err == nil {
+		t.Error("Should reject invalid revision")
+	}
+	if _, err = M.History(".."); err == nil {
+		t.Error("Should reject invalid entries")
+	}
+	if _, err = M.VersionContent("..", first); err == nil {
+		t.Error("Should reject invalid entries")
+	}
+
+	// the domain was taken over while the entry was deleted
+	if err = M.Delete(c.ID(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = M.Add(&UserInput{Name: "Other", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.6:80"}}}); err != nil {
+		t.Fatal(err)
+	}
+	var conflict *DomainConflict
+	if _, err = M.Restore(c.ID(), first); !errors.As(err, &conflict) {
+		t.Errorf("Restore should fail on a domain conflict %v", err)
+	}
+}
+
+func TestRestoreRenamed(t *testing.T) {
+	temp := t.TempDir()
+	M := ConfigManager{Path: path.Join(temp, "dynamic"), CertResolver: "http01", HistoryPath: path.Join(temp, "history")}
+	os.Mkdir(M.Path, 0755)
+	c, err := M.Add(&UserInput{
+		Name:      "Test",
+		Domain:    "test.example.com",
+		HTTPS:     true,
+		Backends:  []Backend{{URL: "http://1.2.3.4:80"}},
+		Headers:   []headersInput{{Name: "X-Test", Value: "yes"}},
+		BasicAuth: []basicAuthInput{{Username: "user", Password: "secret"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.Revision()
+	u, _ := M.Get(c.ID()).ToUserInput()
+	u.Name = "Renamed"
+	if c, err = M.Update(u); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = M.Restore(c.ID(), first); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range c.RouterKeys() {
+		for _, mw := range c.HTTP.Routers[k].Middlewares {
+			if strings.HasPrefix(mw, "Test_") {
+				t.Errorf("Router %s should not reference %s", k, mw)
+			}
+		}
+	}
+	if u, _ = c.ToUserInput(); u.Headers[0].Name != "X-Test" || u.Headers[0].Value != "yes" {
+		t.Errorf("Headers should survive the restore %+v", u.Headers)
+	}
+	if u.BasicAuth[0].Username != "user" || u.BasicAuth[0].Password == "" {
+		t.Errorf("Basic auth should survive the restore %+v", u.BasicAuth)
+	}
+}
+
+func TestWriteFailures(t *testing.T) {
+	failures := []string{}
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01", OnWriteFailure: func(op string) { failures = append(failures, op) }}
+	u := &UserInput{ID: "Test_12345678", Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}}
+	if _, err := M.Update(u); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Should not find the entry %v", err)
+	}
+	if err := M.Delete(u.ID, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Should not find the entry %v", err)
+	}
+	c, err := M.Add(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = M.Add(u); err == nil {
+		t.Error("Should conflict with itself")
+	}
+	if err = M.Delete(c.ID(), "outdated"); err != ErrConflict {
+		t.Errorf("Should conflict %v", err)
+	}
+	if len(failures) != 0 {
+		t.Errorf("Missing entries and conflicts are no write failures %v", failures)
+	}
+	M.Path = path.Join(M.Path, "missing")
+	if _, err = M.Add(u); err == nil {
+		t.Error("Should fail to write")
+	}
+	if err = M.SetCertResolver("dns01"); err == nil {
+		t.Error("Should fail to write")
+	}
+	if !reflect.DeepEqual(failures, []string{"save", "certresolver"}) {
+		t.Errorf("Should count the failed writes %v", failures)
+	}
+}
+
+func TestGitCommits(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01", Git: true}
+	if err := M.InitGit(); err != nil {
+		t.Fatal(err)
+	}
+	me := M.As("https://me.example.com/")
+	c, err := me.Add(&UserInput{Name: "Test", Domain: "test.example.com", HTTPS: true, Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := M.Get(c.ID()).ToUserInput()
+	u.Name = "Renamed"
+	if c, err = me.Update(u); err != nil {
+		t.Fatal(err)
+	}
+	if err = M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	if err = M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	if err = me.Delete(c.ID(), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := git.PlainOpen(M.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, _ := r.Log(&git.LogOptions{})
+	commits := []string{}
+	log.ForEach(func(cm *object.Commit) error {
+		commits = append(commits, cm.Author.Name+" "+cm.Message)
+		return nil
+	})
+	want := []string{
+		"https://me.example.com/ Delete " + c.ID(),
+		"traefik-admin Set cert resolver dns01",
+		"https://me.example.com/ Rename " + strings.Replace(c.ID(), "Renamed", "Test", 1) + " to " + c.ID(),
+		"https://me.example.com/ Add " + strings.Replace(c.ID(), "Renamed", "Test", 1),
+	}
+	if !reflect.DeepEqual(commits, want) {
+		t.Errorf("%v != %v", commits, want)
+	}
+	if w, _ := r.Worktree(); w != nil {
+		if st, _ := w.Status(); !st.IsClean() {
+			t.Errorf("Worktree should be clean %s", st)
+		}
+	}
+}
+
 func TestListUserInputs(t *testing.T) {
 	M := setupSuccess(t)
 
@@ -106,6 +370,24 @@ func TestListUserInputs(t *testing.T) {
 	if err == nil && len(l) == 3 {
 		t.Error("Should be non nil and len=3")
 	}
+
+	// a rule traefik-admin can't parse must not hide the other entries
+	temp := t.TempDir()
+	b, _ := ioutil.ReadFile("./mock/Custom_5e1f0c2a.yaml")
+	b = []byte(strings.Replace(string(b), "rule: Host(`custom.example.com`)\n      service: Custom_5e1f0c2a\n      middlewares", "rule: Host(`custom.example.com`) && ClientIP(`10.0.0.0/8`, \n      service: Custom_5e1f0c2a\n      middlewares", 1))
+	ioutil.WriteFile(path.Join(temp, "Custom_5e1f0c2a.yaml"), b, 0644)
+	M = ConfigManager{Path: temp, CertResolver: "http01"}
+	ui.Name, ui.Domain = "Test", "test.example.com"
+	M.Add(&ui)
+	l, err = M.ListUserInputs()
+	if err != nil || len(l) != 2 {
+		t.Fatalf("Unparsable rule should not fail the list %v %d", err, len(l))
+	}
+	for _, u := range l {
+		if u.ID == "Custom_5e1f0c2a" && !strings.HasPrefix(u.Rule.Raw, "Host(`custom.example.com`) && ClientIP") {
+			t.Errorf("Unparsable rule should be kept as raw %+v", u.Rule)
+		}
+	}
 }
 
 func TestSetCertResolver(t *testing.T) {
@@ -124,12 +406,46 @@ func TestSetCertResolver(t *testing.T) {
 	}
 }
 
+func TestSetCertResolverOnce(t *testing.T) {
+	temp := t.TempDir()
+	M := ConfigManager{Path: path.Join(temp, "dynamic"), CertResolver: "http01", HistoryPath: path.Join(temp, "history")}
+	os.Mkdir(M.Path, 0755)
+	c, err := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", HTTPS: true, Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a hand added second tls router
+	c.HTTP.Routers[c.ID()+"-api"] = &Router{Rule: "Host(`api.example.com`)", Service: c.ID(), TLS: &routerTLSConfig{CertResolver: "http01"}}
+	if err = c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	c = M.Get(c.ID())
+	for k, r := range c.HTTP.Routers {
+		if r.TLS != nil && r.TLS.CertResolver != "dns01" {
+			t.Errorf("CertResolver of %s not switched", k)
+		}
+	}
+	// added, edited by hand and switched
+	if h, _ := M.History(c.ID()); len(h) != 3 {
+		t.Errorf("Should save the entry once, got %d versions", len(h))
+	}
+	if err = M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := M.History(c.ID()); len(h) != 3 {
+		t.Errorf("Should not save unchanged entries, got %d versions", len(h))
+	}
+}
+
 func TestSetForwardAuth(t *testing.T) {
 	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
 	c, _ := M.Add(&UserInput{
 		Name:        "Test",
 		Domain:      "test.example.com",
-		Backend:     Backend{URL: "http://1.2.3.4:80"},
+		Backends:    []Backend{{URL: "http://1.2.3.4:80"}},
 		ForwardAuth: true,
 	})
 	err := M.SetForwardAuth(Remove)
@@ -156,6 +472,67 @@ func TestMigrateConfig(t *testing.T) {
 	}
 }
 
+func TestPreserveUnknownFields(t *testing.T) {
+	temp := t.TempDir()
+	b, _ := ioutil.ReadFile("./mock/Custom_5e1f0c2a.yaml")
+	ioutil.WriteFile(path.Join(temp, "Custom_5e1f0c2a.yaml"), b, 0644)
+	M := ConfigManager{Path: temp, CertResolver: "http01"}
+	if err := M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(c *Config) {
+		id := c.ID()
+		r := c.HTTP.Routers[id]
+		if r.Extra["priority"] != 42 || r.TLS.Extra["options"] != "modern@file" {
+			t.Errorf("Router options lost %+v", r)
+		}
+		if c.HTTP.Services[id].LoadBalancer.Extra["serversTransport"] != "insecure@file" {
+			t.Error("Service options lost")
+		}
+		if mw, ok := c.HTTP.Middlewares[id+"-errors"]; !ok || mw.Extra["errors"] == nil || !r.hasMiddleware(id+"-errors") {
+			t.Error("Errors middleware lost")
+		}
+	}
+	c := M.Get("Custom_5e1f0c2a")
+	check(c)
+	if c.HTTP.Routers["Custom_5e1f0c2a"].TLS.CertResolver != "dns01" {
+		t.Error("CertResolver not switched")
+	}
+
+	// hand added objects referencing each other by name
+	c.HTTP.Services["Custom_5e1f0c2a-errorpage"] = &Service{LoadBalancer: loadbalancer{Servers: []server{{URL: "http://192.168.1.41"}}}}
+	c.HTTP.Middlewares["Custom_5e1f0c2a-errors"].Extra["errors"].(map[interface{}]interface{})["service"] = "Custom_5e1f0c2a-errorpage"
+	c.HTTP.Routers["Custom_5e1f0c2a-api"] = &Router{
+		Rule:        "Host(`api.example.com`)",
+		Service:     "Custom_5e1f0c2a-errorpage",
+		Middlewares: []string{"Custom_5e1f0c2a-errors"},
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := c.ToUserInput()
+	u.Name = "Renamed"
+	u.HSTS = true
+	c, err := M.Update(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = M.Get(c.ID())
+	check(c)
+	id := c.ID()
+	if _, ok := c.HTTP.Services[id+"-errorpage"]; !ok {
+		t.Errorf("Hand added service should be renamed %v", c.ServiceKeys())
+	}
+	r, ok := c.HTTP.Routers[id+"-api"]
+	if !ok || r.Service != id+"-errorpage" || !r.hasMiddleware(id+"-errors") {
+		t.Errorf("Hand added router should be renamed with its references %+v", r)
+	}
+	if s := c.HTTP.Middlewares[id+"-errors"].Extra["errors"].(map[interface{}]interface{})["service"]; s != id+"-errorpage" {
+		t.Errorf("Errors middleware should reference the renamed service, got %v", s)
+	}
+}
+
 func TestSplice(t *testing.T) {
 	s := []string{"One", "Two", "Three", "Four"}
 	if !reflect.DeepEqual(splice(s, "Two"), []string{"One", "Three", "Four"}) {
@@ -13,6 +13,28 @@ const (
 	HSTS        = "sys-hsts@file"
 )
 
+// managedSuffixes are the name suffixes of the middlewares generated per entry
+var managedSuffixes = []string{
+	"-headers", "-basicauth", "-iprestrict",
+	"-stripprefix", "-stripprefixregex", "-addprefix", "-replacepath", "-replacepathregex",
+	"-ratelimit", "-inflight",
+}
+
+// isManaged returns true if the middleware is generated from the user input of
+// the entry with the given id
+func isManaged(id string, name string) bool {
+	switch name {
+	case FORWARDAUTH, REDIRSCHEME, HSTS:
+		return true
+	}
+	for _, s := range managedSuffixes {
+		if name == id+s {
+			return true
+		}
+	}
+	return false
+}
+
 // Middleware defines Traefik Middleware
 type Middleware struct {
 	RedirectScheme RedirectScheme `yaml:"redirectScheme,omitempty"`
@@ -20,42 +42,114 @@ type Middleware struct {
 	BasicAuth      BasicAuth      `yaml:"basicAuth,omitempty"`
 	IPWhiteList    IPWhiteList    `yaml:"ipWhiteList,omitempty"`
 	ForwardAuth    ForwardAuth    `yaml:"forwardAuth,omitempty"`
+
+	StripPrefix      StripPrefix      `yaml:"stripPrefix,omitempty"`
+	StripPrefixRegex StripPrefixRegex `yaml:"stripPrefixRegex,omitempty"`
+	AddPrefix        AddPrefix        `yaml:"addPrefix,omitempty"`
+	ReplacePath      ReplacePath      `yaml:"replacePath,omitempty"`
+	ReplacePathRegex ReplacePathRegex `yaml:"replacePathRegex,omitempty"`
+
+	RateLimit   RateLimit              `yaml:"rateLimit,omitempty"`
+	InFlightReq InFlightReq            `yaml:"inFlightReq,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // RedirectScheme holds data for a schema redirect
 type RedirectScheme struct {
-	Scheme    string `yaml:"scheme"`
-	Permanent bool   `yaml:"permanent"`
+	Scheme    string                 `yaml:"scheme"`
+	Permanent bool                   `yaml:"permanent"`
+	Extra     map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // Headers hold custom headers structure
 type Headers struct {
-	CustomRequestHeaders map[string]string `yaml:"customRequestHeaders,omitempty"`
-	STSSeconds           int64             `yaml:"stsSeconds,omitempty"`
+	CustomRequestHeaders map[string]string      `yaml:"customRequestHeaders,omitempty"`
+	STSSeconds           int64                  `yaml:"stsSeconds,omitempty"`
+	Extra                map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 //BasicAuth holds data for basic authentication
 type BasicAuth struct {
-	Users        []string `yaml:"users,omitempty"`
-	Realm        string   `yaml:"realm,omitempty"`
-	HeaderField  string   `yaml:"headerField,omitempty"`
-	RemoveHeader bool     `yaml:"removeHeader,omitempty"`
+	Users        []string               `yaml:"users,omitempty"`
+	Realm        string                 `yaml:"realm,omitempty"`
+	HeaderField  string                 `yaml:"headerField,omitempty"`
+	RemoveHeader bool                   `yaml:"removeHeader,omitempty"`
+	Extra        map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // IPWhiteList holds the ip white list configuration.
 type IPWhiteList struct {
-	SourceRange []string    `yaml:"sourceRange,omitempty"`
-	IPStrategy  *IPStrategy `yaml:"ipStrategy,omitempty"`
+	SourceRange []string               `yaml:"sourceRange,omitempty"`
+	IPStrategy  *IPStrategy            `yaml:"ipStrategy,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // ForwardAuth holds the forward auth data
 type ForwardAuth struct {
-	Address string `yaml:"address,omitempty"`
+	Address             string                 `yaml:"address,omitempty"`
+	AuthResponseHeaders []string               `yaml:"authResponseHeaders,omitempty"`
+	Extra               map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// StripPrefix removes the given prefixes from the path
+type StripPrefix struct {
+	Prefixes []string               `yaml:"prefixes,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// StripPrefixRegex removes the prefixes matching the given regexes from the path
+type StripPrefixRegex struct {
+	Regex []string               `yaml:"regex,omitempty"`
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// AddPrefix prepends the prefix to the path
+type AddPrefix struct {
+	Prefix string                 `yaml:"prefix,omitempty"`
+	Extra  map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// ReplacePath replaces the whole path
+type ReplacePath struct {
+	Path  string                 `yaml:"path,omitempty"`
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// ReplacePathRegex replaces the path using a regex
+type ReplacePathRegex struct {
+	Regex       string                 `yaml:"regex,omitempty"`
+	Replacement string                 `yaml:"replacement,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// RateLimit limits the average number of requests per period
+type RateLimit struct {
+	Average         int64                  `yaml:"average,omitempty"`
+	Burst           int64                  `yaml:"burst,omitempty"`
+	Period          string                 `yaml:"period,omitempty"`
+	SourceCriterion *SourceCriterion       `yaml:"sourceCriterion,omitempty"`
+	Extra           map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// InFlightReq limits the number of simultaneous requests
+type InFlightReq struct {
+	Amount          int64                  `yaml:"amount,omitempty"`
+	SourceCriterion *SourceCriterion       `yaml:"sourceCriterion,omitempty"`
+	Extra           map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// SourceCriterion defines how requests are grouped for limiting
+type SourceCriterion struct {
+	IPStrategy        *IPStrategy            `yaml:"ipStrategy,omitempty"`
+	RequestHeaderName string                 `yaml:"requestHeaderName,omitempty"`
+	RequestHost       bool                   `yaml:"requestHost,omitempty"`
+	Extra             map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 // IPStrategy holds the ip strategy configuration.
 type IPStrategy struct {
-	Depth int `yaml:"depth,omitempty"`
+	Depth int                    `yaml:"depth,omitempty"`
+	Extra map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 func (h *Headers) fromInput(c *UserInput) {
@@ -78,3 +172,63 @@ func (h *Headers) fromInput(c *UserInput) {
 		}
 	}
 }
+
+func (s *SourceCriterion) fromInput(c sourceCriterion) *SourceCriterion {
+	switch {
+	case c.Depth > 0:
+		s.IPStrategy = &IPStrategy{Depth: c.Depth}
+	case c.Header != "":
+		s.RequestHeaderName = c.Header
+	case c.Host:
+		s.RequestHost = true
+	default:
+		return nil
+	}
+	return s
+}
+
+func (s *SourceCriterion) toInput() sourceCriterion {
+	c := sourceCriterion{}
+	if s == nil {
+		return c
+	}
+	if s.IPStrategy != nil {
+		c.Depth = s.IPStrategy.Depth
+	}
+	c.Header = s.RequestHeaderName
+	c.Host = s.RequestHost
+	return c
+}
+
+// pathMiddlewares returns the path manipulating middlewares requested by the
+// user input by their name suffix, in the order they should be applied
+func pathMiddlewares(p *pathRewrite) ([]string, map[string]*Middleware) {
+	names := []string{}
+	mws := map[string]*Middleware{}
+	if p == nil {
+		return names, mws
+	}
+	add := func(name string, mw *Middleware) {
+		names = append(names, name)
+		mws[name] = mw
+	}
+	if prefixes := spliceEmpty(p.StripPrefix); len(prefixes) > 0 {
+		add("-stripprefix", &Middleware{StripPrefix: StripPrefix{Prefixes: prefixes}})
+	}
+	if regex := spliceEmpty(p.StripPrefixRegex); len(regex) > 0 {
+		add("-stripprefixregex", &Middleware{StripPrefixRegex: StripPrefixRegex{Regex: regex}})
+	}
+	if p.AddPrefix != "" {
+		add("-addprefix", &Middleware{AddPrefix: AddPrefix{Prefix: p.AddPrefix}})
+	}
+	if p.ReplacePath != "" {
+		add("-replacepath", &Middleware{ReplacePath: ReplacePath{Path: p.ReplacePath}})
+	}
+	if p.ReplacePathRegex.Regex != "" {
+		add("-replacepathregex", &Middleware{ReplacePathRegex: ReplacePathRegex{
+			Regex:       p.ReplacePathRegex.Regex,
+			Replacement: p.ReplacePathRegex.Replacement,
+		}})
+	}
+	return names, mws
+}
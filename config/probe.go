@@ -0,0 +1,135 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Probe defines how the health of a backend is checked. Without a path only
+// the tcp connection is checked, with a path the response status has to be
+// within MinStatus and MaxStatus.
+type Probe struct {
+	Path               string
+	MinStatus          int
+	MaxStatus          int
+	Timeout            time.Duration
+	InsecureSkipVerify bool
+	// Scheme replaces the scheme of the backend url like in traefik
+	Scheme string
+	// Headers are sent with the request, a Host header sets the host
+	Headers map[string]string
+}
+
+// ParseStatusRange parses ranges like 200-399 or a single status code
+func ParseStatusRange(s string) (int, int, error) {
+	var min, max int
+	if _, err := fmt.Sscanf(s, "%d-%d", &min, &max); err != nil {
+		if _, err = fmt.Sscanf(s, "%d", &min); err != nil {
+			return 0, 0, fmt.Errorf("invalid status range %s", s)
+		}
+		max = min
+	}
+	if min < 100 || max > 599 || min > max {
+		return 0, 0, fmt.Errorf("invalid status range %s", s)
+	}
+	return min, max, nil
+}
+
+// Probe returns the probe for the entry, the traefik health check of the entry
+// takes precedence over the defaults so the backend is probed like traefik does
+func (u *UserInput) Probe(defaults Probe) Probe {
+	p := defaults
+	if u.LoadBalancer == nil || u.LoadBalancer.HealthCheck.Path == "" {
+		return p
+	}
+	p.Path = u.LoadBalancer.HealthCheck.Path
+	if t, err := time.ParseDuration(u.LoadBalancer.HealthCheck.Timeout); err == nil && t > 0 {
+		p.Timeout = t
+	}
+	p.Scheme = u.LoadBalancer.HealthCheck.Scheme
+	p.Headers = nil
+	for _, h := range u.LoadBalancer.HealthCheck.Headers {
+		if h.Name != "" {
+			if p.Headers == nil {
+				p.Headers = map[string]string{}
+			}
+			p.Headers[h.Name] = h.Value
+		}
+	}
+	if p.MinStatus == 0 {
+		// traefik considers 2xx and 3xx healthy
+		p.MinStatus, p.MaxStatus = 200, 399
+	}
+	return p
+}
+
+// Check probes the backend and records the result in Healthy, StatusCode and Error
+func (b *Backend) Check(p Probe) error {
+	if p.Timeout <= 0 {
+		p.Timeout = 1 * time.Second
+	}
+	b.StatusCode, b.Unknown = 0, false
+	err := b.check(p)
+	b.Healthy = err == nil
+	b.Error = ""
+	if err != nil {
+		b.Error = err.Error()
+	}
+	return err
+}
+
+func (b *Backend) check(p Probe) error {
+	if p.Path == "" {
+		addr := strings.Replace(b.URL, "https://", "", -1)
+		addr = strings.Replace(addr, "http://", "", -1)
+		c, err := net.DialTimeout("tcp", addr, p.Timeout)
+		if c != nil {
+			c.Close()
+		}
+		return err
+	}
+	client := &http.Client{
+		Timeout: p.Timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: p.InsecureSkipVerify},
+			DisableKeepAlives: true,
+		},
+		// a redirect is a valid answer of the backend
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	u, err := url.Parse(strings.TrimSuffix(b.URL, "/") + "/" + strings.TrimPrefix(p.Path, "/"))
+	if err != nil {
+		return err
+	}
+	if p.Scheme != "" {
+		u.Scheme = p.Scheme
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for n, v := range p.Headers {
+		if strings.EqualFold(n, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(n, v)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	b.StatusCode = resp.StatusCode
+	if resp.StatusCode < p.MinStatus || resp.StatusCode > p.MaxStatus {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	if min, max, err := ParseStatusRange("200-399"); err != nil || min != 200 || max != 399 {
+		t.Errorf("Wrong range %d-%d %v", min, max, err)
+	}
+	if min, max, err := ParseStatusRange("204"); err != nil || min != 204 || max != 204 {
+		t.Errorf("Wrong range %d-%d %v", min, max, err)
+	}
+	for _, s := range []string{"", "abc", "399-200", "0-700"} {
+		if _, _, err := ParseStatusRange(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusNoContent)
+		case "/vhost":
+			if r.Host != "app.example.com" || r.Header.Get("X-Probe") != "1" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	p := Probe{Path: "/", MinStatus: 200, MaxStatus: 399, Timeout: time.Second, InsecureSkipVerify: true}
+	b := Backend{URL: srv.URL}
+	if err := b.Connect(); err != nil || !b.Healthy {
+		t.Errorf("Port is open %v", err)
+	}
+	if err := b.Check(p); err == nil || b.Healthy || b.StatusCode != 502 || b.Error == "" {
+		t.Errorf("502 should be unhealthy %+v", b)
+	}
+	p.Path = "moved"
+	if err := b.Check(p); err != nil || b.StatusCode != 302 {
+		t.Errorf("Redirect should be healthy %+v", b)
+	}
+	p.InsecureSkipVerify = false
+	if err := b.Check(p); err == nil || b.StatusCode != 0 {
+		t.Errorf("Self signed certificate should fail %+v", b)
+	}
+
+	u := &UserInput{LoadBalancer: &loadBalancerInput{HealthCheck: healthCheckInput{Path: "/healthz", Timeout: "3s"}}}
+	if p = u.Probe(Probe{}); p.Path != "/healthz" || p.Timeout != 3*time.Second || p.MinStatus != 200 {
+		t.Errorf("Should use the traefik health check %+v", p)
+	}
+	p.InsecureSkipVerify = true
+	if err := b.Check(p); err != nil || b.StatusCode != 204 {
+		t.Errorf("Health check path should be healthy %+v", b)
+	}
+
+	// the backend speaks https on an url configured as http, traefik uses the
+	// scheme and headers of the health check
+	b = Backend{URL: strings.Replace(srv.URL, "https://", "http://", 1)}
+	u.LoadBalancer.HealthCheck.Path = "/vhost"
+	if err := b.Check(u.Probe(Probe{InsecureSkipVerify: true})); err == nil {
+		t.Errorf("Plain http should fail %+v", b)
+	}
+	u.LoadBalancer.HealthCheck.Scheme = "https"
+	u.LoadBalancer.HealthCheck.Headers = []headersInput{{Name: "Host", Value: "app.example.com"}, {Name: "X-Probe", Value: "1"}, {}}
+	if err := b.Check(u.Probe(Probe{InsecureSkipVerify: true})); err != nil || b.StatusCode != 200 {
+		t.Errorf("Should probe with the scheme and headers of the health check %+v", b)
+	}
+}
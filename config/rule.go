@@ -0,0 +1,408 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Rule is the structured form of a traefik router rule. Entries of the same
+// kind are or'ed (paths and path prefixes share one group), the groups and the
+// headers are and'ed together. Raw holds rules which can not be expressed this
+// way and is used as is if set.
+type Rule struct {
+	Hosts      []string     `json:"hosts"`
+	Path       []string     `json:"path"`
+	PathPrefix []string     `json:"pathprefix"`
+	Headers    []ruleHeader `json:"headers"`
+	Methods    []string     `json:"methods"`
+	Raw        string       `json:"raw"`
+}
+
+type ruleHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// String renders the rule in traefik syntax
+func (r Rule) String() string {
+	if r.Raw != "" {
+		return r.Raw
+	}
+	parts := []string{}
+	if g := orGroup("Host", r.Hosts); g != "" {
+		parts = append(parts, g)
+	}
+	paths := []string{}
+	for _, p := range r.Path {
+		paths = append(paths, matcher("Path", p))
+	}
+	for _, p := range r.PathPrefix {
+		paths = append(paths, matcher("PathPrefix", p))
+	}
+	if g := group(paths); g != "" {
+		parts = append(parts, g)
+	}
+	for _, h := range r.Headers {
+		parts = append(parts, matcher("Headers", h.Name, h.Value))
+	}
+	if g := orGroup("Method", r.Methods); g != "" {
+		parts = append(parts, g)
+	}
+	return strings.Join(parts, " && ")
+}
+
+func matcher(name string, args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = quote(a)
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(quoted, ", "))
+}
+
+// quote uses backticks unless the argument contains one, traefik accepts
+// double quoted go strings as well
+func quote(a string) string {
+	if strings.Contains(a, "`") {
+		return strconv.Quote(a)
+	}
+	return "`" + a + "`"
+}
+
+func orGroup(name string, values []string) string {
+	m := []string{}
+	for _, v := range values {
+		m = append(m, matcher(name, v))
+	}
+	return group(m)
+}
+
+func group(matchers []string) string {
+	switch len(matchers) {
+	case 0:
+		return ""
+	case 1:
+		return matchers[0]
+	}
+	return "(" + strings.Join(matchers, " || ") + ")"
+}
+
+// ParseRule converts a traefik rule to its structured form. Rules which are
+// syntactically valid but don't fit the structure are returned in Raw together
+// with the hosts found in it.
+func ParseRule(s string) (Rule, error) {
+	p := &ruleParser{tokens: tokenizeRule(s)}
+	n, err := p.parse()
+	if err != nil {
+		return Rule{}, err
+	}
+	r, ok := n.toRule()
+	if !ok {
+		return Rule{Hosts: n.values("Host"), Raw: s}, nil
+	}
+	return r, nil
+}
+
+type ruleToken struct {
+	kind  byte // i: identifier, s: string, o: operator or punctuation
+	value string
+}
+
+func tokenizeRule(s string) []ruleToken {
+	t := []ruleToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '`':
+			end := strings.IndexByte(s[i+1:], '`')
+			if end < 0 {
+				return append(t, ruleToken{kind: 'e', value: "unterminated string"})
+			}
+			t = append(t, ruleToken{kind: 's', value: s[i+1 : i+1+end]})
+			i += end + 2
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return append(t, ruleToken{kind: 'e', value: "unterminated string"})
+			}
+			v, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return append(t, ruleToken{kind: 'e', value: err.Error()})
+			}
+			t = append(t, ruleToken{kind: 's', value: v})
+			i = end + 1
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||"):
+			t = append(t, ruleToken{kind: 'o', value: s[i : i+2]})
+			i += 2
+		case c == '(' || c == ')' || c == ',' || c == '!':
+			t = append(t, ruleToken{kind: 'o', value: string(c)})
+			i++
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i
+			for end < len(s) && (s[end] >= 'a' && s[end] <= 'z' || s[end] >= 'A' && s[end] <= 'Z' || s[end] >= '0' && s[end] <= '9') {
+				end++
+			}
+			t = append(t, ruleToken{kind: 'i', value: s[i:end]})
+			i = end
+		default:
+			return append(t, ruleToken{kind: 'e', value: fmt.Sprintf("unexpected character %q", c)})
+		}
+	}
+	return t
+}
+
+// ruleNode is either a matcher with its arguments or an operator ("&&", "||", "!")
+// applied to its children
+type ruleNode struct {
+	op       string
+	name     string
+	args     []string
+	children []*ruleNode
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek() ruleToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ruleToken{}
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *ruleParser) expect(v string) error {
+	if t := p.next(); t.kind != 'o' || t.value != v {
+		return fmt.Errorf("expected %q in rule", v)
+	}
+	return nil
+}
+
+func (p *ruleParser) parse() (*ruleNode, error) {
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	n, err := p.parseBinary("||")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in rule", p.peek().value)
+	}
+	return n, nil
+}
+
+// parseBinary parses a sequence of operands joined by op, "&&" binds stronger than "||"
+func (p *ruleParser) parseBinary(op string) (*ruleNode, error) {
+	operand := p.parseUnary
+	if op == "||" {
+		operand = func() (*ruleNode, error) { return p.parseBinary("&&") }
+	}
+	n, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == 'o' && t.value == op; t = p.peek() {
+		p.next()
+		c, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if n.op != op {
+			n = &ruleNode{op: op, children: []*ruleNode{n}}
+		}
+		if c.op == op {
+			n.children = append(n.children, c.children...)
+		} else {
+			n.children = append(n.children, c)
+		}
+	}
+	return n, nil
+}
+
+func (p *ruleParser) parseUnary() (*ruleNode, error) {
+	t := p.next()
+	switch {
+	case t.kind == 'e':
+		return nil, fmt.Errorf("%s in rule", t.value)
+	case t.kind == 'o' && t.value == "!":
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &ruleNode{op: "!", children: []*ruleNode{c}}, nil
+	case t.kind == 'o' && t.value == "(":
+		n, err := p.parseBinary("||")
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	case t.kind == 'i':
+		n := &ruleNode{name: t.value, args: []string{}}
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			a := p.next()
+			if a.kind != 's' {
+				return nil, fmt.Errorf("expected string argument for %s", n.name)
+			}
+			n.args = append(n.args, a.value)
+			if p.peek().value != "," {
+				break
+			}
+			p.next()
+		}
+		return n, p.expect(")")
+	}
+	return nil, fmt.Errorf("unexpected %q in rule", t.value)
+}
+
+// toRule maps the expression onto the structured rule if possible
+func (n *ruleNode) toRule() (Rule, bool) {
+	r := Rule{}
+	conjuncts := []*ruleNode{n}
+	if n.op == "&&" {
+		conjuncts = n.children
+	}
+	seen := map[string]bool{}
+	for _, c := range conjuncts {
+		alternatives := []*ruleNode{c}
+		if c.op == "||" {
+			alternatives = c.children
+		}
+		kind := ""
+		for _, a := range alternatives {
+			k := a.kind()
+			if k == "" || kind != "" && k != kind || k == "headers" && len(alternatives) > 1 {
+				return r, false
+			}
+			kind = k
+		}
+		if seen[kind] && kind != "headers" {
+			return r, false
+		}
+		seen[kind] = true
+		for _, a := range alternatives {
+			switch a.name {
+			case "Host":
+				r.Hosts = append(r.Hosts, a.args...)
+			case "Path":
+				r.Path = append(r.Path, a.args...)
+			case "PathPrefix":
+				r.PathPrefix = append(r.PathPrefix, a.args...)
+			case "Method":
+				r.Methods = append(r.Methods, a.args...)
+			case "Headers", "Header":
+				r.Headers = append(r.Headers, ruleHeader{Name: a.args[0], Value: a.args[1]})
+			}
+		}
+	}
+	return r, true
+}
+
+// kind returns the group a matcher belongs to or an empty string if the node
+// can't be part of the structured rule
+func (n *ruleNode) kind() string {
+	if n.op != "" {
+		return ""
+	}
+	switch n.name {
+	case "Host":
+		return "hosts"
+	case "Path", "PathPrefix":
+		return "paths"
+	case "Method":
+		return "methods"
+	case "Headers", "Header":
+		if len(n.args) == 2 {
+			return "headers"
+		}
+	}
+	return ""
+}
+
+// values returns the arguments of all matchers with the given name used
+// anywhere in the expression
+func (n *ruleNode) values(name string) []string {
+	v := []string{}
+	if n.name == name {
+		v = append(v, n.args...)
+	}
+	for _, c := range n.children {
+		v = append(v, c.values(name)...)
+	}
+	return v
+}
+
+// conflicts returns a host matched by both rules if nothing else tells the
+// rules apart, traefik would then route the requests to either of them.
+// Overlapping rules which differ in their paths, methods or headers are fine
+// because traefik prefers the longer, more specific rule.
+func (r Rule) conflicts(o Rule) string {
+	if r.Raw != "" || o.Raw != "" {
+		if r.Raw == o.Raw {
+			return r.Raw
+		}
+		return ""
+	}
+	if !sameValues(r.Path, o.Path) || !sameValues(r.PathPrefix, o.PathPrefix) || !sameValues(r.Methods, o.Methods) {
+		return ""
+	}
+	rh, oh := []string{}, []string{}
+	for _, h := range r.Headers {
+		if h.Name != "" {
+			rh = append(rh, h.Name+":"+h.Value)
+		}
+	}
+	for _, h := range o.Headers {
+		if h.Name != "" {
+			oh = append(oh, h.Name+":"+h.Value)
+		}
+	}
+	if !sameValues(rh, oh) {
+		return ""
+	}
+	for _, h := range r.Hosts {
+		for _, k := range o.Hosts {
+			if strings.EqualFold(h, k) {
+				return h
+			}
+		}
+	}
+	return ""
+}
+
+// sameValues reports whether a and b contain the same values in any order
+func sameValues(a []string, b []string) bool {
+	a, b = spliceEmpty(a), spliceEmpty(b)
+	if len(a) != len(b) {
+		return false
+	}
+	count := map[string]int{}
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		if count[v] == 0 {
+			return false
+		}
+		count[v]--
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleString(t *testing.T) {
+	cases := []struct {
+		Rule Rule
+		Out  string
+	}{
+		{Rule: Rule{Hosts: []string{"test.example.com"}}, Out: "Host(`test.example.com`)"},
+		{
+			Rule: Rule{Hosts: []string{"a.example.com", "b.example.com"}, PathPrefix: []string{"/grafana"}},
+			Out:  "(Host(`a.example.com`) || Host(`b.example.com`)) && PathPrefix(`/grafana`)",
+		},
+		{
+			Rule: Rule{
+				Hosts:      []string{"test.example.com"},
+				Path:       []string{"/login"},
+				PathPrefix: []string{"/api"},
+				Headers:    []ruleHeader{{Name: "X-Env", Value: "prod"}},
+				Methods:    []string{"GET", "POST"},
+			},
+			Out: "Host(`test.example.com`) && (Path(`/login`) || PathPrefix(`/api`)) && Headers(`X-Env`, `prod`) && (Method(`GET`) || Method(`POST`))",
+		},
+		{Rule: Rule{Hosts: []string{"test.example.com"}, Raw: "HostRegexp(`{any:.+}`)"}, Out: "HostRegexp(`{any:.+}`)"},
+		{
+			Rule: Rule{Hosts: []string{"test.example.com"}, Headers: []ruleHeader{{Name: "X-Quote", Value: "a`b"}}},
+			Out:  "Host(`test.example.com`) && Headers(`X-Quote`, \"a`b\")",
+		},
+	}
+	for _, cs := range cases {
+		if s := cs.Rule.String(); s != cs.Out {
+			t.Errorf("%s != %s", s, cs.Out)
+		}
+		r, err := ParseRule(cs.Out)
+		if err != nil {
+			t.Errorf("Should parse %s: %s", cs.Out, err)
+		}
+		if r.String() != cs.Out {
+			t.Errorf("Round trip of %s yields %s", cs.Out, r.String())
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		In   string
+		Rule Rule
+	}{
+		{In: "Host(`a.example.com`, `b.example.com`)", Rule: Rule{Hosts: []string{"a.example.com", "b.example.com"}}},
+		{In: `Host("test.example.com") && Method("GET")`, Rule: Rule{Hosts: []string{"test.example.com"}, Methods: []string{"GET"}}},
+		{In: "PathPrefix(`/a`) && (Host(`test.example.com`))", Rule: Rule{Hosts: []string{"test.example.com"}, PathPrefix: []string{"/a"}}},
+		{
+			In:   "Host(`test.example.com`) && Headers(`A`, `1`) && Headers(`B`, `2`)",
+			Rule: Rule{Hosts: []string{"test.example.com"}, Headers: []ruleHeader{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}}},
+		},
+		{In: "Host(`test.example.com`) || PathPrefix(`/a`)", Rule: Rule{Hosts: []string{"test.example.com"}, Raw: "Host(`test.example.com`) || PathPrefix(`/a`)"}},
+		{In: "Host(`test.example.com`) && !Method(`GET`)", Rule: Rule{Hosts: []string{"test.example.com"}, Raw: "Host(`test.example.com`) && !Method(`GET`)"}},
+	}
+	for _, cs := range cases {
+		r, err := ParseRule(cs.In)
+		if err != nil {
+			t.Errorf("Should parse %s: %s", cs.In, err)
+		}
+		if !reflect.DeepEqual(r, cs.Rule) {
+			t.Errorf("%s parsed to %+v", cs.In, r)
+		}
+	}
+
+	for _, in := range []string{"", "Host(`a`", "Host(a)", "Host(`a`) &&", "Host(`a`) Host(`b`)", "Host(`a)"} {
+		if _, err := ParseRule(in); err == nil {
+			t.Errorf("%s should fail", in)
+		}
+	}
+}
+
+func TestRuleConflicts(t *testing.T) {
+	base := Rule{Hosts: []string{"a.example.com", "b.example.com"}}
+	cases := []struct {
+		Rule     Rule
+		Conflict string
+	}{
+		{Rule: Rule{Hosts: []string{"B.example.com"}}, Conflict: "b.example.com"},
+		{Rule: Rule{Hosts: []string{"c.example.com"}}},
+		{Rule: Rule{Hosts: []string{"a.example.com"}, PathPrefix: []string{"/api"}}},
+		{Rule: Rule{Hosts: []string{"a.example.com"}, Methods: []string{"GET"}}},
+		{Rule: Rule{Hosts: []string{"a.example.com"}, Headers: []ruleHeader{{Name: "X", Value: "1"}}}},
+		{Rule: Rule{Hosts: []string{"a.example.com"}, Raw: "Host(`a.example.com`) || Path(`/`)"}},
+	}
+	for _, cs := range cases {
+		if c := base.conflicts(cs.Rule); c != cs.Conflict {
+			t.Errorf("%+v should conflict with %q, got %q", cs.Rule, cs.Conflict, c)
+		}
+	}
+	api := Rule{Hosts: []string{"a.example.com"}, PathPrefix: []string{"/api", "/v2"}}
+	if api.conflicts(Rule{Hosts: []string{"a.example.com"}, PathPrefix: []string{"/v2", "/api", ""}}) == "" {
+		t.Error("Same paths in a different order should conflict")
+	}
+}
@@ -0,0 +1,274 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ProtocolTCP marks a stream entry routed by traefik's tcp section
+	ProtocolTCP = "tcp"
+	// ProtocolUDP marks a stream entry routed by traefik's udp section
+	ProtocolUDP = "udp"
+)
+
+// TCP defines the tcp entry struct of traefik
+type TCP struct {
+	Routers  map[string]*TCPRouter     `yaml:"routers,omitempty"`
+	Services map[string]*StreamService `yaml:"services,omitempty"`
+	Extra    map[string]interface{}    `yaml:",inline" json:"-"`
+}
+
+// UDP defines the udp entry struct of traefik
+type UDP struct {
+	Routers  map[string]*UDPRouter     `yaml:"routers,omitempty"`
+	Services map[string]*StreamService `yaml:"services,omitempty"`
+	Extra    map[string]interface{}    `yaml:",inline" json:"-"`
+}
+
+// TCPRouter holds the config part for a tcp router
+type TCPRouter struct {
+	Entrypoints []string               `yaml:"entryPoints,omitempty"`
+	Rule        string                 `yaml:"rule"`
+	Service     string                 `yaml:"service,omitempty"`
+	TLS         *tcpRouterTLSConfig    `yaml:"tls,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type tcpRouterTLSConfig struct {
+	Passthrough  bool                   `yaml:"passthrough,omitempty"`
+	CertResolver string                 `yaml:"certResolver,omitempty"`
+	Extra        map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UDPRouter holds the config part for an udp router, udp has no rules
+type UDPRouter struct {
+	Entrypoints []string               `yaml:"entryPoints,omitempty"`
+	Service     string                 `yaml:"service,omitempty"`
+	Extra       map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// StreamService holds the config part for a tcp or udp service
+type StreamService struct {
+	LoadBalancer streamLoadBalancer     `yaml:"loadBalancer"`
+	Extra        map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type streamLoadBalancer struct {
+	Servers []streamServer         `yaml:"servers"`
+	Extra   map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+type streamServer struct {
+	Address string                 `yaml:"address"`
+	Extra   map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// StreamInput holds the data of a tcp or udp entry submitted by the api request
+type StreamInput struct {
+	ID          string   `json:"id"`
+	Revision    string   `json:"revision"`
+	Name        string   `json:"name"`
+	Protocol    string   `json:"protocol"`
+	EntryPoints []string `json:"entrypoints"`
+	HostSNI     []string `json:"hostsni"`
+	TLS         bool     `json:"tls"`
+	Passthrough bool     `json:"passthrough"`
+	Backends    []string `json:"backends"`
+}
+
+// StreamValidation is the result of validating a StreamInput
+type StreamValidation struct {
+	Valid  bool                  `json:"valid"`
+	Errors StreamValidationError `json:"errors"`
+}
+
+// StreamValidationError provides information about invalid fields
+type StreamValidationError struct {
+	Name        string   `json:"name"`
+	Protocol    string   `json:"protocol"`
+	EntryPoints string   `json:"entrypoints"`
+	HostSNI     string   `json:"hostsni"`
+	Backends    []string `json:"backends"`
+}
+
+// Validate checks the stream input against rules
+func (s *StreamInput) Validate() StreamValidation {
+	v := StreamValidation{Valid: true, Errors: StreamValidationError{Backends: make([]string, len(s.Backends))}}
+	if match, _ := regexp.MatchString("^[a-zA-Z0-9-]{3,32}$", s.Name); !match {
+		v.Valid = false
+		v.Errors.Name = "String between 3 and 32 chars required"
+	}
+	if s.Protocol != ProtocolTCP && s.Protocol != ProtocolUDP {
+		v.Valid = false
+		v.Errors.Protocol = "must be tcp or udp"
+	}
+
+	rex := regexp.MustCompile("^[a-zA-Z0-9-_]{1,64}$")
+	if len(spliceEmpty(s.EntryPoints)) == 0 {
+		v.Valid = false
+		v.Errors.EntryPoints = "at least one entrypoint is required"
+	}
+	for _, e := range spliceEmpty(s.EntryPoints) {
+		if !rex.MatchString(e) {
+			v.Valid = false
+			v.Errors.EntryPoints = "Invalid entrypoint name"
+		}
+	}
+
+	hosts := spliceEmpty(s.HostSNI)
+	rex = regexp.MustCompile("^([a-zA-Z0-9-]+\\.){1,63}[a-zA-Z]{2,6}$")
+	for _, h := range hosts {
+		if !rex.MatchString(h) {
+			v.Valid = false
+			v.Errors.HostSNI = "not a valid domain name"
+		}
+	}
+	if s.Protocol == ProtocolTCP && len(hosts) > 0 && !s.TLS && !s.Passthrough {
+		v.Valid = false
+		v.Errors.HostSNI = "HostSNI requires tls or tls passthrough"
+	}
+	if s.Protocol == ProtocolTCP && (s.TLS || s.Passthrough) && len(hosts) == 0 {
+		v.Valid = false
+		v.Errors.HostSNI = "at least one HostSNI is required with tls"
+	}
+	if s.Protocol == ProtocolUDP && (len(hosts) > 0 || s.TLS || s.Passthrough) {
+		v.Valid = false
+		v.Errors.HostSNI = "udp supports neither HostSNI nor tls"
+	}
+
+	rex = regexp.MustCompile(`^[a-zA-Z0-9.-]+:\d{1,5}$`)
+	for i, b := range s.Backends {
+		if b != "" && !rex.MatchString(b) {
+			v.Valid = false
+			v.Errors.Backends[i] = "Format: 192.168.1.12:1883"
+		}
+	}
+	if len(spliceEmpty(s.Backends)) == 0 {
+		v.Valid = false
+		if len(v.Errors.Backends) == 0 {
+			v.Errors.Backends = make([]string, 1)
+		}
+		v.Errors.Backends[0] = "at least one backend is required"
+	}
+	return v
+}
+
+// Protocol returns the protocol of the entry or an empty string for http entries
+func (c *Config) Protocol() string {
+	switch {
+	case len(c.TCP.Routers) > 0:
+		return ProtocolTCP
+	case len(c.UDP.Routers) > 0:
+		return ProtocolUDP
+	}
+	return ""
+}
+
+// FromStreamInput converts the stream input to a config, nil is returned if the
+// input is invalid
+func FromStreamInput(s *StreamInput, certresolver string) *Config {
+	return fromStreamInput(s, certresolver, s.Name+"_"+RandHash())
+}
+
+// fromStreamInput converts the stream input to a config with the given id
+func fromStreamInput(s *StreamInput, certresolver string, id string) *Config {
+	if !s.Validate().Valid {
+		return nil
+	}
+	c := &Config{id: id}
+	lb := streamLoadBalancer{Servers: []streamServer{}}
+	for _, b := range spliceEmpty(s.Backends) {
+		lb.Servers = append(lb.Servers, streamServer{Address: b})
+	}
+	services := map[string]*StreamService{c.id: {LoadBalancer: lb}}
+
+	if s.Protocol == ProtocolUDP {
+		c.UDP = UDP{
+			Routers:  map[string]*UDPRouter{c.id: {Entrypoints: spliceEmpty(s.EntryPoints), Service: c.id}},
+			Services: services,
+		}
+		return c
+	}
+
+	r := &TCPRouter{
+		Entrypoints: spliceEmpty(s.EntryPoints),
+		Rule:        "HostSNI(`*`)",
+		Service:     c.id,
+	}
+	if hosts := spliceEmpty(s.HostSNI); len(hosts) > 0 {
+		m := []string{}
+		for _, h := range hosts {
+			m = append(m, matcher("HostSNI", h))
+		}
+		r.Rule = strings.Join(m, " || ")
+	}
+	switch {
+	case s.Passthrough:
+		r.TLS = &tcpRouterTLSConfig{Passthrough: true}
+	case s.TLS:
+		r.TLS = &tcpRouterTLSConfig{CertResolver: certresolver}
+	}
+	c.TCP = TCP{
+		Routers:  map[string]*TCPRouter{c.id: r},
+		Services: services,
+	}
+	return c
+}
+
+// ToStreamInput converts a tcp or udp config to the struct used by the frontend
+func (c *Config) ToStreamInput() (*StreamInput, error) {
+	if err := c.Load(); err != nil {
+		return nil, err
+	}
+	id := c.ID()
+	s := &StreamInput{
+		ID:          id,
+		Revision:    c.revision,
+		Name:        c.Name(),
+		Protocol:    c.Protocol(),
+		EntryPoints: []string{},
+		HostSNI:     []string{},
+		Backends:    []string{},
+	}
+	var svc *StreamService
+	switch s.Protocol {
+	case ProtocolTCP:
+		r, ok := c.TCP.Routers[id]
+		if !ok {
+			return nil, fmt.Errorf("tcp router %s not found", id)
+		}
+		s.EntryPoints = r.Entrypoints
+		p := &ruleParser{tokens: tokenizeRule(r.Rule)}
+		n, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range n.values("HostSNI") {
+			if h != "*" {
+				s.HostSNI = append(s.HostSNI, h)
+			}
+		}
+		if r.TLS != nil {
+			s.Passthrough = r.TLS.Passthrough
+			s.TLS = !r.TLS.Passthrough
+		}
+		svc = c.TCP.Services[r.Service]
+	case ProtocolUDP:
+		r, ok := c.UDP.Routers[id]
+		if !ok {
+			return nil, fmt.Errorf("udp router %s not found", id)
+		}
+		s.EntryPoints = r.Entrypoints
+		svc = c.UDP.Services[r.Service]
+	default:
+		return nil, fmt.Errorf("%s is not a tcp or udp config", id)
+	}
+	if svc != nil {
+		for _, srv := range svc.LoadBalancer.Servers {
+			s.Backends = append(s.Backends, srv.Address)
+		}
+	}
+	return s, nil
+}
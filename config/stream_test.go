@@ -0,0 +1,109 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+var mqtt StreamInput = StreamInput{
+	Name:        "MQTT",
+	Protocol:    ProtocolTCP,
+	EntryPoints: []string{"mqtts"},
+	HostSNI:     []string{"mqtt.example.com", "broker.example.com"},
+	TLS:         true,
+	Backends:    []string{"192.168.1.10:1883", ""},
+}
+
+func TestStreamValidation(t *testing.T) {
+	if v := mqtt.Validate(); !v.Valid {
+		t.Errorf("Should be valid %+v", v.Errors)
+	}
+	cases := []StreamInput{
+		{Name: "SSH", Protocol: "sctp", EntryPoints: []string{"ssh"}, Backends: []string{"1.2.3.4:22"}},
+		{Name: "SSH", Protocol: ProtocolTCP, Backends: []string{"1.2.3.4:22"}},
+		{Name: "SSH", Protocol: ProtocolTCP, EntryPoints: []string{"ssh"}, HostSNI: []string{"ssh.example.com"}, Backends: []string{"1.2.3.4:22"}},
+		{Name: "SSH", Protocol: ProtocolTCP, EntryPoints: []string{"ssh"}, Passthrough: true, Backends: []string{"1.2.3.4:22"}},
+		{Name: "DNS", Protocol: ProtocolUDP, EntryPoints: []string{"dns"}, TLS: true, Backends: []string{"1.2.3.4:53"}},
+		{Name: "DNS", Protocol: ProtocolUDP, EntryPoints: []string{"dns"}, Backends: []string{"udp://1.2.3.4:53"}},
+		{Name: "DNS", Protocol: ProtocolUDP, EntryPoints: []string{"dns"}},
+	}
+	for _, cs := range cases {
+		if cs.Validate().Valid {
+			t.Errorf("%+v should be invalid", cs)
+		}
+	}
+}
+
+func TestStreamConversion(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	c, err := M.AddStream(&mqtt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.TCP.Routers[c.id]
+	if r.Rule != "HostSNI(`mqtt.example.com`) || HostSNI(`broker.example.com`)" || r.TLS.CertResolver != "http01" {
+		t.Errorf("Wrong tcp router %+v", r)
+	}
+
+	game := StreamInput{Name: "Game", Protocol: ProtocolUDP, EntryPoints: []string{"game"}, Backends: []string{"192.168.1.11:27015"}}
+	if _, err = M.AddStream(&game); err != nil {
+		t.Fatal(err)
+	}
+	ssh := StreamInput{Name: "SSH", Protocol: ProtocolTCP, EntryPoints: []string{"ssh"}, Backends: []string{"192.168.1.12:22"}}
+	if c, err = M.AddStream(&ssh); err != nil || c.TCP.Routers[c.id].Rule != "HostSNI(`*`)" {
+		t.Fatalf("Should add ssh with catch all rule %v", err)
+	}
+	if _, err = M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sl, err := M.ListStreamInputs()
+	if err != nil || len(sl) != 3 {
+		t.Fatalf("Should list 3 streams, got %d %v", len(sl), err)
+	}
+	ul, err := M.ListUserInputs()
+	if err != nil || len(ul) != 1 {
+		t.Fatalf("Should list 1 http entry, got %d %v", len(ul), err)
+	}
+	for _, s := range sl {
+		var want StreamInput
+		switch s.Name {
+		case "MQTT":
+			want = mqtt
+			want.Backends = []string{"192.168.1.10:1883"}
+		case "Game":
+			want = game
+			want.HostSNI = []string{}
+		case "SSH":
+			want = ssh
+			want.HostSNI = []string{}
+		}
+		want.ID = s.ID
+		want.Revision = s.Revision
+		if !reflect.DeepEqual(s, want) {
+			t.Errorf("%+v != %+v", s, want)
+		}
+	}
+
+	mqttID := ""
+	for _, e := range sl {
+		if e.Name == "MQTT" {
+			mqttID = e.ID
+		}
+	}
+	s, _ := M.Get(mqttID).ToStreamInput()
+	if err = M.SetCertResolver("dns01"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = M.UpdateStream(s); err != ErrConflict {
+		t.Errorf("Should conflict after the cert resolver changed, got %v", err)
+	}
+	s, _ = M.Get(mqttID).ToStreamInput()
+	s.Passthrough, s.TLS = true, false
+	if c, err = M.UpdateStream(s); err != nil {
+		t.Fatal(err)
+	}
+	if !c.TCP.Routers[c.id].TLS.Passthrough {
+		t.Error("Should be passthrough")
+	}
+}
@@ -1,25 +1,33 @@
 package config
 
 import (
-	"net"
 	"regexp"
-	"strings"
 	"time"
 )
 
 // UserInput hold the data submitted by the api request
 type UserInput struct {
-	ID            string           `json:"id"`
-	Name          string           `json:"name"`
-	Domain        string           `json:"domain"`
-	Backend       Backend          `json:"backend"`
-	ForwardAuth   bool             `json:"forwardauth"`
-	HTTPS         bool             `json:"https"`
-	ForceTLS      bool             `json:"forcetls"`
-	HSTS          bool             `json:"hsts"`
-	Headers       []headersInput   `json:"headers"`
-	BasicAuth     []basicAuthInput `json:"basicauth"`
-	IPRestriction *ipRestriction   `json:"ipRestriction"`
+	ID            string             `json:"id"`
+	Revision      string             `json:"revision"`
+	Name          string             `json:"name"`
+	Domain        string             `json:"domain"`
+	Rule          Rule               `json:"rule"`
+	Backends      []Backend          `json:"backends"`
+	ForwardAuth   bool               `json:"forwardauth"`
+	HTTPS         bool               `json:"https"`
+	ForceTLS      bool               `json:"forcetls"`
+	HSTS          bool               `json:"hsts"`
+	Headers       []headersInput     `json:"headers"`
+	BasicAuth     []basicAuthInput   `json:"basicauth"`
+	IPRestriction *ipRestriction     `json:"ipRestriction"`
+	PathRewrite   *pathRewrite       `json:"pathRewrite"`
+	RateLimit     *rateLimit         `json:"rateLimit"`
+	InFlight      *inFlight          `json:"inFlight"`
+	LoadBalancer  *loadBalancerInput `json:"loadBalancer"`
+	AccessPolicy  *AccessPolicy      `json:"accessPolicy"`
+	// hashedPasswords is set for imported entries, their basic auth passwords
+	// are the bcrypt hashes of the export
+	hashedPasswords bool
 }
 
 type headersInput struct {
@@ -37,6 +45,75 @@ type ipRestriction struct {
 	IPs   []string `json:"ips"`
 }
 
+type pathRewrite struct {
+	StripPrefix      []string         `json:"stripprefix"`
+	StripPrefixRegex []string         `json:"stripprefixregex"`
+	AddPrefix        string           `json:"addprefix"`
+	ReplacePath      string           `json:"replacepath"`
+	ReplacePathRegex replacePathRegex `json:"replacepathregex"`
+}
+
+type replacePathRegex struct {
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+type rateLimit struct {
+	Average         int64           `json:"average"`
+	Burst           int64           `json:"burst"`
+	Period          string          `json:"period"`
+	SourceCriterion sourceCriterion `json:"sourcecriterion"`
+}
+
+type inFlight struct {
+	Amount          int64           `json:"amount"`
+	SourceCriterion sourceCriterion `json:"sourcecriterion"`
+}
+
+// sourceCriterion groups the requests by client ip (with the given proxy
+// depth), by the value of a request header or by the requested host
+type sourceCriterion struct {
+	Depth  int    `json:"depth"`
+	Header string `json:"header"`
+	Host   bool   `json:"host"`
+}
+
+// loadBalancerInput holds the options of the service, passHostHeader
+// defaults to true if not set
+type loadBalancerInput struct {
+	PassHostHeader *bool            `json:"passhostheader"`
+	HealthCheck    healthCheckInput `json:"healthcheck"`
+	Sticky         stickyInput      `json:"sticky"`
+}
+
+type healthCheckInput struct {
+	Path     string         `json:"path"`
+	Interval string         `json:"interval"`
+	Timeout  string         `json:"timeout"`
+	Scheme   string         `json:"scheme"`
+	Headers  []headersInput `json:"headers"`
+}
+
+type stickyInput struct {
+	Enabled  bool   `json:"enabled"`
+	Name     string `json:"name"`
+	Secure   bool   `json:"secure"`
+	HTTPOnly bool   `json:"httponly"`
+	SameSite string `json:"samesite"`
+}
+
+func (s stickyInput) toConfig() *sticky {
+	if !s.Enabled {
+		return nil
+	}
+	return &sticky{Cookie: &stickyCookie{
+		Name:     s.Name,
+		Secure:   s.Secure,
+		HTTPOnly: s.HTTPOnly,
+		SameSite: s.SameSite,
+	}}
+}
+
 type Validation struct {
 	Valid  bool            `json:"valid"`
 	Errors ValidationError `json:"errors"`
@@ -44,12 +121,64 @@ type Validation struct {
 
 //ValidationError provides information about invalid fields
 type ValidationError struct {
-	Name      string      `json:"name"`
-	Domain    string      `json:"domain"`
-	Backend   string      `json:"backend"`
-	BasicAuth []basicAuth `json:"basicauth"`
-	AllowedIP allowedIP   `json:"allowedip"`
-	Headers   []header    `json:"headers"`
+	Name        string           `json:"name"`
+	Domain      string           `json:"domain"`
+	Rule        ruleError        `json:"rule"`
+	Backend     string           `json:"backend"`
+	Backends    []backend        `json:"backends"`
+	BasicAuth   []basicAuth      `json:"basicauth"`
+	AllowedIP   allowedIP        `json:"allowedip"`
+	Headers     []header         `json:"headers"`
+	PathRewrite pathRewriteError `json:"pathrewrite"`
+	RateLimit   rateLimitError   `json:"ratelimit"`
+	InFlight    inFlightError    `json:"inflight"`
+	HealthCheck healthCheckError `json:"healthcheck"`
+	Sticky      stickyError      `json:"sticky"`
+}
+
+type ruleError struct {
+	Paths   string `json:"paths"`
+	Headers string `json:"headers"`
+	Methods string `json:"methods"`
+	Raw     string `json:"raw"`
+}
+
+type backend struct {
+	URL    string `json:"url"`
+	Weight string `json:"weight"`
+}
+
+type pathRewriteError struct {
+	StripPrefix      string `json:"stripprefix"`
+	StripPrefixRegex string `json:"stripprefixregex"`
+	AddPrefix        string `json:"addprefix"`
+	ReplacePath      string `json:"replacepath"`
+	ReplacePathRegex string `json:"replacepathregex"`
+}
+
+type rateLimitError struct {
+	Average         string `json:"average"`
+	Burst           string `json:"burst"`
+	Period          string `json:"period"`
+	SourceCriterion string `json:"sourcecriterion"`
+}
+
+type inFlightError struct {
+	Amount          string `json:"amount"`
+	SourceCriterion string `json:"sourcecriterion"`
+}
+
+type healthCheckError struct {
+	Path     string `json:"path"`
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+	Scheme   string `json:"scheme"`
+	Headers  string `json:"headers"`
+}
+
+type stickyError struct {
+	Name     string `json:"name"`
+	SameSite string `json:"samesite"`
 }
 
 type basicAuth struct {
@@ -67,19 +196,21 @@ type header struct {
 	Value string `json:"value"`
 }
 
+// Backend is a server the requests are forwarded to, the weight is only
+// relevant if there are multiple backends
 type Backend struct {
-	URL     string `json:"url"`
-	Healthy bool   `json:"healthy"`
+	URL        string `json:"url"`
+	Weight     int    `json:"weight"`
+	Healthy    bool   `json:"healthy"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Unknown is set for backends which were not checked yet
+	Unknown bool `json:"unknown,omitempty"`
 }
 
-func (b *Backend) Connect() {
-	addr := strings.Replace(b.URL, "https://", "", -1)
-	addr = strings.Replace(addr, "http://", "", -1)
-	c, err := net.DialTimeout("tcp", addr, 1*time.Second)
-	b.Healthy = err == nil
-	if c != nil {
-		c.Close()
-	}
+// Connect checks if the backend accepts tcp connections and returns the dial error
+func (b *Backend) Connect() error {
+	return b.Check(Probe{})
 }
 
 func NewValidation() Validation {
@@ -87,6 +218,7 @@ func NewValidation() Validation {
 		Valid: true,
 		Errors: ValidationError{
 			Name: "", Domain: "", Backend: "",
+			Backends:  make([]backend, 5),
 			BasicAuth: make([]basicAuth, 5),
 			AllowedIP: allowedIP{NoProxies: "", IP: make([]string, 5)},
 			Headers:   make([]header, 5),
@@ -107,15 +239,75 @@ func (u *UserInput) Validate() Validation {
 		v.Errors.Name = "String between 3 and 32 chars required"
 	}
 
-	if match, _ = regexp.MatchString("^([a-zA-Z0-9]+\\.){2,63}[a-zA-Z]{2,6}$", u.Domain); !match {
-		v.Valid = false
-		v.Errors.Domain = "not a valid domain name"
+	rule := u.rule()
+	if rule.Raw != "" {
+		if _, err := ParseRule(rule.Raw); err != nil {
+			v.Valid = false
+			v.Errors.Rule.Raw = err.Error()
+		}
+	} else {
+		rex = regexp.MustCompile("^([a-zA-Z0-9]+\\.){2,63}[a-zA-Z]{2,6}$")
+		if len(rule.Hosts) == 0 {
+			v.Valid = false
+			v.Errors.Domain = "not a valid domain name"
+		}
+		for _, h := range rule.Hosts {
+			if match = rex.MatchString(h); !match {
+				v.Valid = false
+				v.Errors.Domain = "not a valid domain name"
+			}
+		}
+		// the domain is ignored if the rule has hosts, changing only the
+		// domain must not pass silently
+		if u.Domain != "" && !contains(rule.Hosts, u.Domain) {
+			v.Valid = false
+			v.Errors.Domain = "domain must be one of the rule hosts"
+		}
+		rex = regexp.MustCompile("^/[^`]{0,255}$")
+		for _, p := range append(append([]string{}, rule.Path...), rule.PathPrefix...) {
+			if match = rex.MatchString(p); !match {
+				v.Valid = false
+				v.Errors.Rule.Paths = "paths must start with /"
+			}
+		}
+		rex = regexp.MustCompile("^[a-zA-Z0-9-_]{1,64}$")
+		rex2 = regexp.MustCompile("^[^`]{1,128}$")
+		for _, h := range rule.Headers {
+			if match = rex.MatchString(h.Name) && rex2.MatchString(h.Value); !match {
+				v.Valid = false
+				v.Errors.Rule.Headers = "Invalid header name or value"
+			}
+		}
+		rex = regexp.MustCompile("^(GET|HEAD|POST|PUT|PATCH|DELETE|OPTIONS|CONNECT|TRACE)$")
+		for _, m := range rule.Methods {
+			if match = rex.MatchString(m); !match {
+				v.Valid = false
+				v.Errors.Rule.Methods = "Invalid http method"
+			}
+		}
 	}
 
 	// ToDo: improve validation (regarding ip addresses)
-	if match, _ = regexp.MatchString("^http(s)?:\\/\\/[a-zA-Z0-9.]+:\\d{0,5}$", u.Backend.URL); !match {
+	rex = regexp.MustCompile("^http(s)?:\\/\\/[a-zA-Z0-9.]+:\\d{0,5}$")
+	if len(u.Backends) > len(v.Errors.Backends) {
+		v.Errors.Backends = make([]backend, len(u.Backends))
+	}
+	for i, b := range u.Backends {
+		if b.URL == "" && b.Weight == 0 {
+			continue
+		}
+		if match = rex.MatchString(b.URL); !match {
+			v.Valid = false
+			v.Errors.Backends[i].URL = "Format: http://192.168.1.12:5000"
+		}
+		if !inBetween(b.Weight, 0, 1000) {
+			v.Valid = false
+			v.Errors.Backends[i].Weight = "must be between 0 and 1000"
+		}
+	}
+	if len(u.backends()) == 0 {
 		v.Valid = false
-		v.Errors.Backend = "Format: http://192.168.1.12:5000"
+		v.Errors.Backend = "at least one backend is required"
 	}
 
 	rex = regexp.MustCompile("^[a-zA-Z0-9]{3,32}$")
@@ -165,9 +357,154 @@ func (u *UserInput) Validate() Validation {
 		}
 	}
 
+	// Path rewrite checks
+	if u.PathRewrite != nil {
+		rex = regexp.MustCompile("^/[^ ]{0,255}$")
+		for _, p := range u.PathRewrite.StripPrefix {
+			if match = rex.MatchString(p); !match && p != "" {
+				v.Valid = false
+				v.Errors.PathRewrite.StripPrefix = "prefixes must start with /"
+			}
+		}
+		for _, r := range u.PathRewrite.StripPrefixRegex {
+			if _, err := regexp.Compile(r); err != nil {
+				v.Valid = false
+				v.Errors.PathRewrite.StripPrefixRegex = "Invalid regex"
+			}
+		}
+		if match = rex.MatchString(u.PathRewrite.AddPrefix); !match && u.PathRewrite.AddPrefix != "" {
+			v.Valid = false
+			v.Errors.PathRewrite.AddPrefix = "prefix must start with /"
+		}
+		if match = rex.MatchString(u.PathRewrite.ReplacePath); !match && u.PathRewrite.ReplacePath != "" {
+			v.Valid = false
+			v.Errors.PathRewrite.ReplacePath = "path must start with /"
+		}
+		rr := u.PathRewrite.ReplacePathRegex
+		if _, err := regexp.Compile(rr.Regex); err != nil {
+			v.Valid = false
+			v.Errors.PathRewrite.ReplacePathRegex = "Invalid regex"
+		} else if (rr.Regex == "") != (rr.Replacement == "") {
+			v.Valid = false
+			v.Errors.PathRewrite.ReplacePathRegex = "regex and replacement required"
+		}
+	}
+
+	// Rate limit checks
+	if u.RateLimit != nil {
+		if u.RateLimit.Average < 0 || u.RateLimit.Average > 100000 {
+			v.Valid = false
+			v.Errors.RateLimit.Average = "must be between 0 and 100000"
+		}
+		if u.RateLimit.Burst < 0 || u.RateLimit.Burst > 100000 {
+			v.Valid = false
+			v.Errors.RateLimit.Burst = "must be between 0 and 100000"
+		}
+		if d, err := time.ParseDuration(u.RateLimit.Period); u.RateLimit.Period != "" && (err != nil || d <= 0) {
+			v.Valid = false
+			v.Errors.RateLimit.Period = "Format: 1s, 10m or 1h"
+		}
+		v.Errors.RateLimit.SourceCriterion = u.RateLimit.SourceCriterion.validate()
+	}
+	if u.InFlight != nil {
+		if u.InFlight.Amount < 0 || u.InFlight.Amount > 10000 {
+			v.Valid = false
+			v.Errors.InFlight.Amount = "must be between 0 and 10000"
+		}
+		v.Errors.InFlight.SourceCriterion = u.InFlight.SourceCriterion.validate()
+	}
+	if v.Errors.RateLimit.SourceCriterion != "" || v.Errors.InFlight.SourceCriterion != "" {
+		v.Valid = false
+	}
+
+	// Load balancer checks
+	if u.LoadBalancer != nil {
+		hc := u.LoadBalancer.HealthCheck
+		if match, _ = regexp.MatchString("^/[^ ]{0,255}$", hc.Path); !match && hc.Path != "" {
+			v.Valid = false
+			v.Errors.HealthCheck.Path = "path must start with /"
+		}
+		if d, err := time.ParseDuration(hc.Interval); hc.Interval != "" && (err != nil || d <= 0) {
+			v.Valid = false
+			v.Errors.HealthCheck.Interval = "Format: 10s, 1m"
+		}
+		if d, err := time.ParseDuration(hc.Timeout); hc.Timeout != "" && (err != nil || d <= 0) {
+			v.Valid = false
+			v.Errors.HealthCheck.Timeout = "Format: 3s, 1m"
+		}
+		if hc.Scheme != "" && hc.Scheme != "http" && hc.Scheme != "https" {
+			v.Valid = false
+			v.Errors.HealthCheck.Scheme = "must be http or https"
+		}
+		rex = regexp.MustCompile("^[a-zA-Z0-9-_]{1,64}$")
+		for _, h := range hc.Headers {
+			if (h.Name != "" || h.Value != "") && !rex.MatchString(h.Name) {
+				v.Valid = false
+				v.Errors.HealthCheck.Headers = "Invalid header name"
+			} else if h.Name != "" && hc.Path == "" {
+				// the health check is only written with a path, the headers would be lost
+				v.Valid = false
+				v.Errors.HealthCheck.Headers = "headers require a health check path"
+			}
+		}
+		st := u.LoadBalancer.Sticky
+		if st.Name != "" && !rex.MatchString(st.Name) {
+			v.Valid = false
+			v.Errors.Sticky.Name = "Invalid cookie name"
+		}
+		if match, _ = regexp.MatchString("^(|none|lax|strict)$", st.SameSite); !match {
+			v.Valid = false
+			v.Errors.Sticky.SameSite = "must be none, lax or strict"
+		}
+	}
+
 	return v
 }
 
+// validate returns an error message if the criterion is invalid
+func (c sourceCriterion) validate() string {
+	set := 0
+	if c.Depth != 0 {
+		set++
+	}
+	if c.Header != "" {
+		set++
+	}
+	if c.Host {
+		set++
+	}
+	switch {
+	case set > 1:
+		return "only one of proxy depth, header or host allowed"
+	case !inBetween(c.Depth, 0, 30):
+		return "proxy depth must be between 0 and 30"
+	case c.Header != "" && !regexp.MustCompile("^[a-zA-Z0-9-_]{1,64}$").MatchString(c.Header):
+		return "Invalid header name"
+	}
+	return ""
+}
+
+// rule returns the routing rule, the domain is used as host if the rule
+// has none. Otherwise the domain has to be one of the hosts, see Validate.
+func (u *UserInput) rule() Rule {
+	r := u.Rule
+	if len(r.Hosts) == 0 && u.Domain != "" {
+		r.Hosts = []string{u.Domain}
+	}
+	return r
+}
+
+// backends returns the backends with an url set
+func (u *UserInput) backends() []Backend {
+	b := []Backend{}
+	for _, e := range u.Backends {
+		if e.URL != "" {
+			b = append(b, e)
+		}
+	}
+	return b
+}
+
 func inBetween(i, min, max int) bool {
 	return i >= min && i <= max
 }
@@ -19,7 +19,7 @@ func TestConnect(t *testing.T) {
 func TestValidation(t *testing.T) {
 	ui.Name = "123.Test"
 	ui.Domain = "1241234"
-	ui.Backend = Backend{URL: "test.example.com"}
+	ui.Backends = []Backend{{URL: "test.example.com", Weight: 1001}}
 	ui.BasicAuth[0].Username = "aerg.1241t$"
 	ui.BasicAuth[0].Password = ""
 	ui.BasicAuth = append(ui.BasicAuth, basicAuthInput{})
@@ -37,3 +37,37 @@ func TestValidation(t *testing.T) {
 		t.Error("Should be invalid")
 	}
 }
+
+func TestRuleValidation(t *testing.T) {
+	u := UserInput{
+		Name:     "Test",
+		Backends: []Backend{{URL: "http://1.2.3.4:80"}},
+		Rule: Rule{
+			Hosts:      []string{"a.example.com", "b.example.com"},
+			PathPrefix: []string{"/grafana"},
+			Methods:    []string{"GET"},
+		},
+	}
+	if v := u.Validate(); !v.Valid {
+		t.Errorf("Should be valid %+v", v.Errors)
+	}
+	u.Domain = "a.example.com"
+	if v := u.Validate(); !v.Valid {
+		t.Errorf("Domain of the rule hosts should be valid %+v", v.Errors)
+	}
+	u.Domain = "c.example.com"
+	if v := u.Validate(); v.Valid || v.Errors.Domain == "" {
+		t.Error("Domain outside the rule hosts should be invalid")
+	}
+	u.Domain = ""
+	u.Rule.PathPrefix = []string{"grafana"}
+	u.Rule.Methods = []string{"FETCH"}
+	v := u.Validate()
+	if v.Valid || v.Errors.Rule.Paths == "" || v.Errors.Rule.Methods == "" {
+		t.Error("Should be invalid")
+	}
+	u.Rule = Rule{Raw: "Host(`a.example.com`"}
+	if v = u.Validate(); v.Valid || v.Errors.Rule.Raw == "" {
+		t.Error("Should be invalid")
+	}
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pheelee/traefik-admin/logger"
+)
+
+// EventType describes what happened to an entry
+type EventType string
+
+const (
+	// EventCreated is published for new entry files
+	EventCreated EventType = "created"
+	// EventUpdated is published if the content of an entry file changed
+	EventUpdated EventType = "updated"
+	// EventDeleted is published for removed entry files
+	EventDeleted EventType = "deleted"
+)
+
+// Event is published whenever an entry file changes, no matter if it was
+// changed through the api or by hand
+type Event struct {
+	Type     EventType `json:"type"`
+	ID       string    `json:"id"`
+	Revision string    `json:"revision,omitempty"`
+}
+
+// index caches the entry files of a watched config path
+type index struct {
+	sync.Mutex
+	watcher *fsnotify.Watcher
+	files   []string
+	// configs holds the parsed entry files by id until they are modified,
+	// generation changes with every invalidation
+	configs     map[string]*Config
+	generation  int
+	revisions   map[string]string
+	subscribers map[chan Event]struct{}
+}
+
+// Watch keeps an index of the entries which is invalidated by file system
+// events and publishes an Event for every changed entry
+func (m *ConfigManager) Watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = w.Add(m.Path); err != nil {
+		w.Close()
+		return err
+	}
+	idx := &index{watcher: w, configs: map[string]*Config{}, revisions: map[string]string{}, subscribers: map[chan Event]struct{}{}}
+	files, err := m.readDir()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	for _, f := range files {
+		if b, err := ioutil.ReadFile(path.Join(m.Path, f)); err == nil {
+			idx.revisions[strings.TrimSuffix(f, ".yaml")] = revision(b)
+		}
+	}
+	m.index = idx
+	go m.watch(idx)
+	return nil
+}
+
+// Close stops watching the config path
+func (m *ConfigManager) Close() error {
+	if m.index == nil {
+		return nil
+	}
+	return m.index.watcher.Close()
+}
+
+// Subscribe returns a channel receiving all events until cancel is called.
+// Slow subscribers miss events instead of blocking the watcher. Without Watch
+// the channel never receives anything.
+func (m *ConfigManager) Subscribe() (<-chan Event, func()) {
+	if m.index == nil {
+		return nil, func() {}
+	}
+	ch := make(chan Event, 16)
+	m.index.Lock()
+	m.index.subscribers[ch] = struct{}{}
+	m.index.Unlock()
+	return ch, func() {
+		m.index.Lock()
+		defer m.index.Unlock()
+		if _, ok := m.index.subscribers[ch]; ok {
+			delete(m.index.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (m *ConfigManager) watch(idx *index) {
+	for {
+		select {
+		case e, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			name := path.Base(e.Name)
+			if !isEntryFile(name) {
+				continue
+			}
+			id := strings.TrimSuffix(name, ".yaml")
+			m.invalidate(id)
+			m.refresh(idx, id)
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error(fmt.Sprintf("watching %s failed: %s", m.Path, err))
+		}
+	}
+}
+
+// refresh compares the entry file with the index and publishes the change
+func (m *ConfigManager) refresh(idx *index, id string) {
+	e := Event{ID: id}
+	b, err := ioutil.ReadFile(path.Join(m.Path, id+".yaml"))
+	idx.Lock()
+	defer idx.Unlock()
+	old, known := idx.revisions[id]
+	switch {
+	case os.IsNotExist(err) && known:
+		e.Type = EventDeleted
+		delete(idx.revisions, id)
+	case err != nil:
+		return
+	case !known:
+		e.Type = EventCreated
+	case old != revision(b):
+		e.Type = EventUpdated
+	default:
+		return
+	}
+	if e.Type != EventDeleted {
+		e.Revision = revision(b)
+		idx.revisions[id] = e.Revision
+	}
+	for ch := range idx.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// invalidate drops the cached file list and the parsed configs of the given
+// entries after they were modified, all configs are dropped without ids
+func (m *ConfigManager) invalidate(ids ...string) {
+	if m.index == nil {
+		return
+	}
+	m.index.Lock()
+	defer m.index.Unlock()
+	m.index.files = nil
+	m.index.generation++
+	if len(ids) == 0 {
+		m.index.configs = map[string]*Config{}
+	}
+	for _, id := range ids {
+		delete(m.index.configs, id)
+	}
+}
+
+// load parses the entry file unless the index already holds it. The config
+// may be shared with other readers and must not be modified.
+func (m *ConfigManager) load(c *Config) error {
+	if m.index == nil {
+		return c.Load()
+	}
+	id := c.ID()
+	m.index.Lock()
+	cached, ok := m.index.configs[id]
+	generation := m.index.generation
+	m.index.Unlock()
+	if ok {
+		*c = *cached
+		return nil
+	}
+	if err := c.Load(); err != nil {
+		return err
+	}
+	m.index.Lock()
+	defer m.index.Unlock()
+	// the file may have changed while it was parsed
+	if generation == m.index.generation {
+		cached := *c
+		m.index.configs[id] = &cached
+	}
+	return nil
+}
+
+// isEntryFile reports whether the file in the config path is an entry
+func isEntryFile(name string) bool {
+	return path.Ext(name) == ".yaml" && !strings.HasPrefix(name, "sys_") && !strings.HasPrefix(name, ".")
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	M := ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	if err := M.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer M.Close()
+	events, cancel := M.Subscribe()
+	defer cancel()
+	next := func(want EventType) Event {
+		for {
+			select {
+			case e := <-events:
+				if e.Type == want {
+					return e
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("No %s event", want)
+			}
+		}
+	}
+
+	c, err := M.Add(&UserInput{Name: "Test", Domain: "test.example.com", Backends: []Backend{{URL: "http://1.2.3.4:80"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl, _ := M.List(); len(cl) != 1 {
+		t.Errorf("Should list the new entry right away, got %d", len(cl))
+	}
+	if e := next(EventCreated); e.ID != c.ID() || e.Revision != c.Revision() {
+		t.Errorf("Wrong event %+v", e)
+	}
+
+	// the parsed entry is kept until the file changes
+	if ul, _ := M.ListUserInputs(); len(ul) != 1 || M.index.configs[c.ID()] == nil {
+		t.Fatalf("Should cache the parsed entry %+v", ul)
+	}
+	u, _ := c.ToUserInput()
+	u.Backends = []Backend{{URL: "http://1.2.3.5:80"}}
+	if c, err = M.Update(u); err != nil {
+		t.Fatal(err)
+	}
+	if ul, _ := M.ListUserInputs(); ul[0].Backends[0].URL != "http://1.2.3.5:80" {
+		t.Errorf("Should drop the cached entry on update %+v", ul[0].Backends)
+	}
+	if e := next(EventUpdated); e.Revision != c.Revision() {
+		t.Errorf("Wrong event %+v", e)
+	}
+
+	// edit by hand
+	b, _ := ioutil.ReadFile(c.Path)
+	ioutil.WriteFile(c.Path, bytes.Replace(b, []byte("1.2.3.5"), []byte("1.2.3.6"), 1), 0644)
+	if e := next(EventUpdated); e.ID != c.ID() || e.Revision == c.Revision() {
+		t.Errorf("Wrong event %+v", e)
+	}
+	if ul, _ := M.ListUserInputs(); ul[0].Backends[0].URL != "http://1.2.3.6:80" {
+		t.Errorf("Should drop the cached entry on file events %+v", ul[0].Backends)
+	}
+	ioutil.WriteFile(path.Join(M.Path, "Hand_0123abcd.yaml"), b, 0644)
+	if e := next(EventCreated); e.ID != "Hand_0123abcd" {
+		t.Errorf("Wrong event %+v", e)
+	}
+	if cl, _ := M.List(); len(cl) != 2 {
+		t.Errorf("Should list the hand written entry, got %d", len(cl))
+	}
+	os.Remove(c.Path)
+	if e := next(EventDeleted); e.ID != c.ID() {
+		t.Errorf("Wrong event %+v", e)
+	}
+}
@@ -12,9 +12,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/peterhellberg/link"
 	"willnorris.com/go/microformats"
 )
@@ -30,6 +30,9 @@ var (
 	// ErrForbidden is returned when the authorization endpoint answered a 403
 	ErrForbidden = errors.New("authorization endpoint answered with forbidden")
 
+	// ErrNotAllowed is returned when the verified identity is not in the allowlist
+	ErrNotAllowed = errors.New("identity is not allowed")
+
 	// ErrAuthorizationEndpointNotFound is returned when the authorization_endpoint could not be discovered for the given URL
 	ErrAuthorizationEndpointNotFound = errors.New("authorization_endpoint not found")
 
@@ -70,20 +73,28 @@ type IndieAuth struct {
 	me           string
 	authEndpoint string
 	store        *sessions.CookieStore
-	cache        *lru.Cache
 
 	// ClientID will try to guess the client ID from the request by default
 	ClientID func(r *http.Request) string
 	// RedirectPath will default to `/indieauth-redirect`
 	RedirectPath string
+	// StateKey signs the state of the logins, it defaults to a random key so
+	// replicas have to share it
+	StateKey []byte
+	// StateTTL will default to DefaultStateTTL
+	StateTTL time.Duration
+	// OnLogin is called when a login completed or failed in the RedirectHandler
+	OnLogin func(ok bool)
+	// Allowed lists the profile URLs which may log in, all identities verified
+	// by the authorization endpoint are allowed if it is empty
+	Allowed []string
+	// Forbidden answers logins which were rejected, defaults to a plain 403
+	Forbidden func(w http.ResponseWriter, r *http.Request, me string)
 }
 
 // New initializes an IndieAuth auth manager, the `Middleware` shortcut is the preferred API unless you want fine-grained configuration.
 func New(store *sessions.CookieStore, me string, authEndpoint string) (*IndieAuth, error) {
-	c, err := lru.New(64)
-	if err != nil {
-		return nil, err
-	}
+	var err error
 	if authEndpoint == "" {
 		authEndpoint, err = getAuthEndpoint(me)
 	}
@@ -91,13 +102,18 @@ func New(store *sessions.CookieStore, me string, authEndpoint string) (*IndieAut
 	if err != nil {
 		return nil, fmt.Errorf("failed to get \"authorization_endpoint\": %v", err)
 	}
+	key := make([]byte, 32)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
 	ia := &IndieAuth{
 		me:           me,
 		authEndpoint: authEndpoint,
 		store:        store,
-		cache:        c,
 		ClientID:     defaultClientID,
 		RedirectPath: DefaultRedirectPath,
+		StateKey:     key,
+		StateTTL:     DefaultStateTTL,
 	}
 	return ia, nil
 }
@@ -163,54 +179,102 @@ func (ia *IndieAuth) verifyCode(r *http.Request, code string) (*verifyResp, erro
 		return nil, ErrForbidden
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, err
+		return nil, fmt.Errorf("authorization endpoint answered with %s", resp.Status)
 	}
 	vresp := &verifyResp{}
 	if err := json.NewDecoder(resp.Body).Decode(vresp); err != nil {
-		panic(err)
+		return nil, err
+	}
+	if vresp.Me == "" {
+		return nil, errors.New("authorization endpoint did not return an identity")
 	}
 	return vresp, nil
 }
 
+// canonicalURL normalizes profile URLs so that https://Example.com and
+// https://example.com/ are the same identity
+func canonicalURL(s string) string {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || u.Host == "" {
+		return strings.TrimSpace(s)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	return u.String()
+}
+
+// IsAllowed returns true if the identity may log in
+func (ia *IndieAuth) IsAllowed(me string) bool {
+	if len(ia.Allowed) == 0 {
+		return true
+	}
+	me = canonicalURL(me)
+	for _, a := range ia.Allowed {
+		if canonicalURL(a) == me {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden rejects a login
+func (ia *IndieAuth) forbidden(w http.ResponseWriter, r *http.Request, me string) {
+	if ia.Forbidden != nil {
+		ia.Forbidden(w, r, me)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+}
+
 // RedirectHandler is a HTTP handler that must be registered on the app at `/indieauth-redirect`
 func (ia *IndieAuth) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// Extract query parameters
 		q := r.URL.Query()
-		me := q.Get("me")
 		code := q.Get("code")
 		state := q.Get("state")
 
-		// Sanity check
-		if me != ia.me {
-			//		panic("invalid me")
-		}
-
 		// Verify the state/nonce to protect from XSRF attacks
-		p, validState := ia.cache.Get(state)
-		if !validState {
-			panic(fmt.Errorf("invalid state"))
+		p, err := ia.verifyState(w, r, state)
+		if err != nil {
+			ia.observe(ia.OnLogin, false)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		ia.cache.Remove(state)
-
 		// Verify the code against the remote IndieAuth server
-		if _, err := ia.verifyCode(r, code); err != nil {
-			if err == ErrForbidden {
-				w.WriteHeader(http.StatusForbidden)
+		// Only the identity verified by the endpoint counts, the query can be forged
+		resp, err := ia.verifyCode(r, code)
+		if err == nil && !ia.IsAllowed(resp.Me) {
+			err = ErrNotAllowed
+		}
+		ia.observe(ia.OnLogin, err == nil)
+		if err != nil {
+			switch err {
+			case ErrForbidden:
+				ia.forbidden(w, r, "")
+				return
+			case ErrNotAllowed:
+				ia.forbidden(w, r, resp.Me)
 				return
 			}
 			panic(err)
 		}
+		me := resp.Me
 
 		// Update the session
 		session, _ := ia.store.Get(r, SessionName)
 		session.Values["logged_in"] = true
+		session.Values["me"] = me
 		session.Save(r, w)
 
 		// Redirect the user to the page requested before the login
-		http.Redirect(w, r, p.(string), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, p, http.StatusTemporaryRedirect)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -224,17 +288,12 @@ func (ia *IndieAuth) Redirect(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	// Generate a random state that will act as a XSRF token
-	rawState := make([]byte, 12)
-	if _, err := rand.Read(rawState); err != nil {
+	// The signed state carries the page requested before the login
+	url := r.Header.Get("X-Forwarded-Proto") + "://" + r.Header.Get("X-Forwarded-Host") + r.Header.Get("X-Forwarded-Uri")
+	state, err := ia.newState(w, r, url)
+	if err != nil {
 		return err
 	}
-	state := fmt.Sprintf("%x", rawState)
-
-	// Store the state in the LRU cache
-	//FIXME(tsileo): store the "redirect path" in the state (base64 JS with token + redirect path + HMAC?) and remove the LRU?
-	url := r.Header.Get("X-Forwarded-Proto") + "://" + r.Header.Get("X-Forwarded-Host") + r.Header.Get("X-Forwarded-Uri")
-	ia.cache.Add(state, url)
 
 	// Add the query params
 	q := pu.Query()
@@ -250,33 +309,39 @@ func (ia *IndieAuth) Redirect(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// Check returns true if there is an existing session with a valid login
+// CallbackPath returns the path the RedirectHandler has to be served at
+func (ia *IndieAuth) CallbackPath() string {
+	return ia.RedirectPath
+}
+
+// Check returns true if there is an existing session with a valid login of
+// an allowed identity
 func (ia *IndieAuth) Check(r *http.Request) bool {
 	// Check if there's a session and if the the user is already logged in
 	session, _ := ia.store.Get(r, SessionName)
 	loggedIn, ok := session.Values["logged_in"]
-	return ok && loggedIn.(bool)
+	if !ok || !loggedIn.(bool) {
+		return false
+	}
+	// sessions survive changes of the allowlist, sessions created before the
+	// identity was stored have to log in again
+	me, _ := session.Values["me"].(string)
+	return me != "" && ia.IsAllowed(me)
 }
 
-// Middleware provides a middleware that will only allow user authenticated against the given IndiAuth endpoint
-func (ia *IndieAuth) Middleware() func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.URL.Path != ia.RedirectPath && !ia.Check(r) {
-				if err := ia.Redirect(w, r); err != nil {
-					if err == ErrForbidden {
-						w.WriteHeader(http.StatusForbidden)
-						return
-					}
-					panic(err)
-				}
-				return
-			}
+// Me returns the identity of the logged in user or an empty string
+func (ia *IndieAuth) Me(r *http.Request) string {
+	if !ia.Check(r) {
+		return ""
+	}
+	session, _ := ia.store.Get(r, SessionName)
+	me, _ := session.Values["me"].(string)
+	return me
+}
 
-			// The user is already logged in
-			next.ServeHTTP(w, r)
-			return
-		})
+func (ia *IndieAuth) observe(f func(bool), ok bool) {
+	if f != nil {
+		f(ok)
 	}
 }
 
@@ -287,5 +352,6 @@ func (ia *IndieAuth) Logout(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 	session.Values["logged_in"] = false
+	delete(session.Values, "me")
 	session.Save(r, w)
 }
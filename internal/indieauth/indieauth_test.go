@@ -0,0 +1,143 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// login runs the redirect and the callback against the given endpoint and
+// returns the response of the callback
+func login(t *testing.T, ia *IndieAuth) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://admin.example.com/auth", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "app.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/dashboard")
+	w := httptest.NewRecorder()
+	if err := ia.Redirect(w, r); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := httptest.NewRequest("GET", "https://app.example.com"+ia.RedirectPath+"?code=abc&me=https://forged.example.com/&state="+loc.Query().Get("state"), nil)
+	for _, c := range w.Result().Cookies() {
+		cb.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	ia.RedirectHandler(w, cb)
+	return w
+}
+
+func TestAllowlist(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(verifyResp{Me: "https://Alice.example.com"})
+	}))
+	defer endpoint.Close()
+
+	ia, err := New(sessions.NewCookieStore([]byte("secret")), "http://localhost/endpoints", endpoint.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forbidden := ""
+	ia.Forbidden = func(w http.ResponseWriter, r *http.Request, me string) {
+		forbidden = me
+		w.WriteHeader(http.StatusForbidden)
+	}
+
+	ia.Allowed = []string{"https://bob.example.com/"}
+	if w := login(t, ia); w.Code != http.StatusForbidden || forbidden != "https://Alice.example.com" {
+		t.Errorf("Alice should be rejected %d %s", w.Code, forbidden)
+	}
+
+	ia.Allowed = []string{"https://bob.example.com/", "https://alice.example.com/"}
+	w := login(t, ia)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "https://app.example.com/dashboard" {
+		t.Fatalf("Alice should be logged in %d %s", w.Code, w.Header().Get("Location"))
+	}
+	r := httptest.NewRequest("GET", "http://admin.example.com/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if me := ia.Me(r); me != "https://Alice.example.com" {
+		t.Errorf("Session should carry the verified identity, got %s", me)
+	}
+
+	ia.Allowed = []string{"https://bob.example.com/"}
+	if ia.Check(r) {
+		t.Errorf("Sessions of removed identities should be invalid")
+	}
+
+	// sessions from before the identity was stored
+	ia.Allowed = nil
+	old := httptest.NewRequest("GET", "http://admin.example.com/", nil)
+	w = httptest.NewRecorder()
+	s, _ := ia.store.Get(old, SessionName)
+	s.Values["logged_in"] = true
+	s.Save(old, w)
+	for _, c := range w.Result().Cookies() {
+		old.AddCookie(c)
+	}
+	if ia.Check(old) || ia.Me(old) != "" {
+		t.Errorf("Sessions without identity should be invalid")
+	}
+}
+
+func TestState(t *testing.T) {
+	ia, err := New(sessions.NewCookieStore([]byte("secret")), "http://localhost/endpoints", "https://auth.example.com/authorize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ia.StateKey = []byte("shared")
+	r := httptest.NewRequest("GET", "http://admin.example.com/auth", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	token, err := ia.newState(w, r, "https://app.example.com/dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].Path != ia.RedirectPath {
+		t.Fatalf("Wrong state cookie %+v", cookies)
+	}
+	callback := func(token string, withCookie bool) (string, error) {
+		cb := httptest.NewRequest("GET", "https://app.example.com"+ia.RedirectPath, nil)
+		if withCookie {
+			cb.AddCookie(cookies[0])
+		}
+		return ia.verifyState(httptest.NewRecorder(), cb, token)
+	}
+
+	// a replica or a restarted instance with the same key accepts the state
+	other, _ := New(sessions.NewCookieStore([]byte("secret")), "http://localhost/endpoints", "https://auth.example.com/authorize")
+	other.StateKey = []byte("shared")
+	ia, other = other, ia
+	if u, err := callback(token, true); err != nil || u != "https://app.example.com/dashboard" {
+		t.Errorf("Valid state should pass %s %v", u, err)
+	}
+	if _, err := callback(token, false); err == nil {
+		t.Errorf("State without the cookie should be rejected")
+	}
+	if _, err := callback(token[:len(token)-2]+"xx", true); err == nil {
+		t.Errorf("Tampered state should be rejected")
+	}
+	ia.StateKey = []byte("other")
+	if _, err := callback(token, true); err == nil {
+		t.Errorf("State signed with another key should be rejected")
+	}
+	ia.StateKey, ia.StateTTL = []byte("shared"), -time.Minute
+	w = httptest.NewRecorder()
+	if token, err = ia.newState(w, r, "https://app.example.com/"); err != nil {
+		t.Fatal(err)
+	}
+	cookies = w.Result().Cookies()
+	if _, err := callback(token, true); err == nil {
+		t.Errorf("Expired state should be rejected")
+	}
+}
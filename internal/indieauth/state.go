@@ -0,0 +1,100 @@
+package indieauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidState is returned when the state of a login was not issued by
+	// this instance, expired or does not belong to the browser
+	ErrInvalidState = errors.New("invalid state")
+
+	// StateCookieName is the name of the cookie binding the state to the browser
+	StateCookieName = "indieauth_state"
+
+	// DefaultStateTTL is the time a user has to complete the login
+	DefaultStateTTL = 10 * time.Minute
+)
+
+// state is the payload of the state parameter, it carries everything needed
+// to complete the login so no server side storage is involved
+type state struct {
+	Nonce    string `json:"n"`
+	Redirect string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+// sign returns the payload with its HMAC in the form payload.signature
+func (ia *IndieAuth) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, ia.StateKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newState issues a state for the redirect target and binds it to the browser
+// with a short lived cookie holding the nonce
+func (ia *IndieAuth) newState(w http.ResponseWriter, r *http.Request, redirect string) (string, error) {
+	rawNonce := make([]byte, 16)
+	if _, err := rand.Read(rawNonce); err != nil {
+		return "", err
+	}
+	s := state{
+		Nonce:    base64.RawURLEncoding.EncodeToString(rawNonce),
+		Redirect: redirect,
+		Expires:  time.Now().Add(ia.StateTTL).Unix(),
+	}
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookieName,
+		Value:    s.Nonce,
+		Path:     ia.RedirectPath,
+		MaxAge:   int(ia.StateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return ia.sign(payload), nil
+}
+
+// verifyState checks the signature, the expiry and the binding to the browser
+// of the state and returns the redirect target. The state cookie is removed.
+func (ia *IndieAuth) verifyState(w http.ResponseWriter, r *http.Request, token string) (string, error) {
+	http.SetCookie(w, &http.Cookie{Name: StateCookieName, Path: ia.RedirectPath, MaxAge: -1})
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalidState
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidState
+	}
+	if !hmac.Equal([]byte(ia.sign(payload)), []byte(token)) {
+		return "", ErrInvalidState
+	}
+	var s state
+	if err = json.Unmarshal(payload, &s); err != nil {
+		return "", ErrInvalidState
+	}
+	if time.Now().Unix() > s.Expires {
+		return "", fmt.Errorf("%w: expired", ErrInvalidState)
+	}
+	c, err := r.Cookie(StateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(s.Nonce)) != 1 {
+		return "", fmt.Errorf("%w: not started in this browser", ErrInvalidState)
+	}
+	return s.Redirect, nil
+}
@@ -0,0 +1,289 @@
+/*
+Package monitor checks the backends of all proxy entries in the background and
+keeps a short history of the results per entry
+*/
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/logger"
+)
+
+// Result is the outcome of checking all backends of an entry once, the entry
+// is up if all of its backends are reachable
+type Result struct {
+	Time    time.Time `json:"time"`
+	Up      bool      `json:"up"`
+	Latency float64   `json:"latency"`
+	// StatusCode is the highest status code returned by the backends of http probes
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Status summarizes the recent results of an entry
+type Status struct {
+	ID          string   `json:"id"`
+	Up          bool     `json:"up"`
+	Uptime      float64  `json:"uptime"`
+	Transitions int      `json:"transitions"`
+	Last        *Result  `json:"last"`
+	History     []Result `json:"history"`
+}
+
+// ring keeps the latest results of an entry
+type ring struct {
+	results []Result
+	next    int
+	full    bool
+}
+
+func (r *ring) add(res Result) {
+	r.results[r.next] = res
+	r.next = (r.next + 1) % len(r.results)
+	r.full = r.full || r.next == 0
+}
+
+// list returns the results oldest first
+func (r *ring) list() []Result {
+	if !r.full {
+		return append([]Result{}, r.results[:r.next]...)
+	}
+	return append(append([]Result{}, r.results[r.next:]...), r.results[:r.next]...)
+}
+
+type backendKey struct {
+	ID  string
+	URL string
+}
+
+// Monitor checks the backends of all entries in the given interval
+type Monitor struct {
+	Interval time.Duration
+	// Size is the number of results kept per entry
+	Size int
+	// Probe is used for entries without a traefik health check path
+	Probe config.Probe
+	// OnChange is called whenever a backend becomes healthy or unhealthy,
+	// backends which are down on their first check count as becoming unhealthy
+	OnChange func(id string, b config.Backend)
+	// OnCheck is called with the result of every check of an entry
+	OnCheck func(id string, r Result)
+
+	mu       sync.RWMutex
+	entries  map[string]*ring
+	backends map[backendKey]config.Backend
+}
+
+// New returns a monitor keeping size results per entry
+func New(interval time.Duration, size int) *Monitor {
+	if size < 1 {
+		size = 1
+	}
+	return &Monitor{
+		Interval: interval,
+		Size:     size,
+		entries:  map[string]*ring{},
+		backends: map[backendKey]config.Backend{},
+	}
+}
+
+// Run checks all entries right away and then in the configured interval until
+// the context is done
+func (m *Monitor) Run(ctx context.Context) {
+	t := time.NewTicker(m.Interval)
+	defer t.Stop()
+	for {
+		if err := m.CheckAll(); err != nil {
+			logger.Error(fmt.Sprintf("health check failed: %s", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// CheckAll checks the backends of all entries concurrently and forgets about
+// entries which no longer exist
+func (m *Monitor) CheckAll() error {
+	ul, err := config.Manager.ListUserInputs()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	for i := range ul {
+		wg.Add(1)
+		go func(u *config.UserInput) {
+			defer wg.Done()
+			m.Check(u)
+		}(&ul[i])
+	}
+	wg.Wait()
+
+	ids := map[string]bool{}
+	for _, u := range ul {
+		ids[u.ID] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.entries {
+		if !ids[id] {
+			delete(m.entries, id)
+		}
+	}
+	for k := range m.backends {
+		if !ids[k.ID] {
+			delete(m.backends, k)
+		}
+	}
+	return nil
+}
+
+// Check probes all backends of the entry and records the result
+func (m *Monitor) Check(u *config.UserInput) Result {
+	res := Result{Time: time.Now(), Up: true}
+	probe := u.Probe(m.Probe)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range u.Backends {
+		if u.Backends[i].URL == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(b *config.Backend) {
+			defer wg.Done()
+			start := time.Now()
+			err := b.Check(probe)
+			latency := float64(time.Since(start).Microseconds()) / 1000
+			mu.Lock()
+			defer mu.Unlock()
+			if latency > res.Latency {
+				res.Latency = latency
+			}
+			if err != nil {
+				res.Up = false
+				if res.Error == "" {
+					res.Error = fmt.Sprintf("%s: %s", b.URL, err)
+				}
+			}
+			if b.StatusCode > res.StatusCode {
+				res.StatusCode = b.StatusCode
+			}
+		}(&u.Backends[i])
+	}
+	wg.Wait()
+
+	changed := []config.Backend{}
+	m.mu.Lock()
+	r, ok := m.entries[u.ID]
+	if !ok {
+		r = &ring{results: make([]Result, m.Size)}
+		m.entries[u.ID] = r
+	}
+	r.add(res)
+	current := map[backendKey]bool{}
+	for _, b := range u.Backends {
+		if b.URL == "" {
+			continue
+		}
+		k := backendKey{ID: u.ID, URL: b.URL}
+		// a backend which is already down when it is first checked never
+		// changes away from healthy
+		if old, known := m.backends[k]; known && old.Healthy != b.Healthy || !known && !b.Healthy {
+			changed = append(changed, b)
+		}
+		m.backends[k] = b
+		current[k] = true
+	}
+	for k := range m.backends {
+		if k.ID == u.ID && !current[k] {
+			delete(m.backends, k)
+		}
+	}
+	m.mu.Unlock()
+
+	if m.OnChange != nil {
+		for _, b := range changed {
+			m.OnChange(u.ID, b)
+		}
+	}
+	if m.OnCheck != nil {
+		m.OnCheck(u.ID, res)
+	}
+	return res
+}
+
+// Backends returns the last known state of all checked backends by entry id
+func (m *Monitor) Backends() map[string][]config.Backend {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bl := map[string][]config.Backend{}
+	for k, b := range m.backends {
+		bl[k.ID] = append(bl[k.ID], b)
+	}
+	return bl
+}
+
+// Apply sets the health of the backends of the entry to the last known state,
+// backends which were not checked yet are reported as unknown
+func (m *Monitor) Apply(u *config.UserInput) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i, b := range u.Backends {
+		u.Backends[i].Healthy, u.Backends[i].Unknown = false, true
+		if known, ok := m.backends[backendKey{ID: u.ID, URL: b.URL}]; ok {
+			u.Backends[i] = known
+			u.Backends[i].Weight = b.Weight
+		}
+	}
+}
+
+// Status returns the summary of the entry, ok is false if it was not checked yet
+func (m *Monitor) Status(id string) (Status, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r, ok := m.entries[id]
+	if !ok {
+		return Status{}, false
+	}
+	s := Status{ID: id, History: r.list()}
+	up := 0
+	for i, res := range s.History {
+		if res.Up {
+			up++
+		}
+		if i > 0 && res.Up != s.History[i-1].Up {
+			s.Transitions++
+		}
+	}
+	last := s.History[len(s.History)-1]
+	s.Last = &last
+	s.Up = last.Up
+	s.Uptime = float64(up) * 100 / float64(len(s.History))
+	return s, true
+}
+
+// Statuses returns the summary of all checked entries ordered by id
+func (m *Monitor) Statuses() []Status {
+	m.mu.RLock()
+	ids := []string{}
+	for id := range m.entries {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+	sl := []Status{}
+	for _, id := range ids {
+		if s, ok := m.Status(id); ok {
+			sl = append(sl, s)
+		}
+	}
+	return sl
+}
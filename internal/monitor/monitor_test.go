@@ -0,0 +1,64 @@
+package monitor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+)
+
+func TestRing(t *testing.T) {
+	r := &ring{results: make([]Result, 3)}
+	for i := 0; i < 5; i++ {
+		r.add(Result{Latency: float64(i)})
+	}
+	l := r.list()
+	if len(l) != 3 || l[0].Latency != 2 || l[2].Latency != 4 {
+		t.Errorf("Wrong order %+v", l)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	u := &config.UserInput{ID: "Test_01234567", Backends: []config.Backend{{URL: "http://" + addr}}}
+
+	m := New(time.Minute, 10)
+	changes := 0
+	m.OnChange = func(id string, b config.Backend) { changes++ }
+	if res := m.Check(u); !res.Up {
+		t.Fatalf("Should be up %+v", res)
+	}
+	l.Close()
+	if res := m.Check(u); res.Up || res.Error == "" {
+		t.Fatalf("Should be down %+v", res)
+	}
+	s, ok := m.Status(u.ID)
+	if !ok || s.Up || s.Uptime != 50 || s.Transitions != 1 || len(s.History) != 2 || changes != 1 {
+		t.Errorf("Wrong status %+v, %d changes", s, changes)
+	}
+
+	list := &config.UserInput{ID: u.ID, Backends: []config.Backend{{URL: "http://" + addr, Weight: 2}, {URL: "http://unknown:80"}}}
+	m.Apply(list)
+	// a new monitor sees the backend down right away
+	m = New(time.Minute, 10)
+	changes = 0
+	m.OnChange = func(id string, b config.Backend) {
+		if !b.Healthy {
+			changes++
+		}
+	}
+	m.Check(u)
+	m.Check(u)
+	if changes != 1 {
+		t.Errorf("Backend down on the first check should be reported once, got %d", changes)
+	}
+
+	if list.Backends[0].Healthy || list.Backends[0].Unknown || list.Backends[0].Weight != 2 || list.Backends[1].Healthy || !list.Backends[1].Unknown {
+		t.Errorf("Wrong health applied %+v", list.Backends)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+Package notify sends webhooks when a backend of a proxy entry goes down or
+recovers
+*/
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// TypeGeneric posts the Event as json
+	TypeGeneric = "generic"
+	// TypeNtfy posts a plain text message to a ntfy topic url
+	TypeNtfy = "ntfy"
+	// TypeGotify posts a message to the /message endpoint of a gotify server
+	TypeGotify = "gotify"
+)
+
+// Hook is a single webhook target, the url is a secret as well because
+// services like ntfy authorize by the topic in the path
+type Hook struct {
+	Name    string            `yaml:"name" json:"name"`
+	Type    string            `yaml:"type" json:"type"`
+	URL     string            `yaml:"url" json:"-"`
+	Token   string            `yaml:"token" json:"-"`
+	Headers map[string]string `yaml:"headers" json:"-"`
+}
+
+// Config holds the webhooks and when they are fired
+type Config struct {
+	// Debounce is the time a backend has to stay in its new state before a
+	// notification is sent
+	Debounce time.Duration `yaml:"debounce"`
+	// MinDown is the minimum time a backend has to be down before a down
+	// notification is sent
+	MinDown time.Duration `yaml:"minDown"`
+	// Retries is the number of additional attempts for failed deliveries
+	Retries int    `yaml:"retries"`
+	Hooks   []Hook `yaml:"hooks"`
+}
+
+// Event is the payload of the generic webhook
+type Event struct {
+	Event      string     `json:"event"`
+	Entry      string     `json:"entry"`
+	Name       string     `json:"name"`
+	Backend    string     `json:"backend"`
+	StatusCode int        `json:"statusCode,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	DownSince  *time.Time `json:"downSince,omitempty"`
+	Time       time.Time  `json:"time"`
+}
+
+// Delivery records the outcome of sending an event to a hook
+type Delivery struct {
+	Time     time.Time `json:"time"`
+	Hook     string    `json:"hook"`
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Status   int       `json:"status"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// LoadConfig reads the webhook config from a yaml file
+func LoadConfig(path string) (Config, error) {
+	c := Config{Debounce: 30 * time.Second, MinDown: time.Minute, Retries: 3}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err = yaml.Unmarshal(b, &c); err != nil {
+		return c, err
+	}
+	for i, h := range c.Hooks {
+		switch h.Type {
+		case "":
+			c.Hooks[i].Type = TypeGeneric
+		case TypeGeneric, TypeNtfy, TypeGotify:
+		default:
+			return c, fmt.Errorf("unknown webhook type %s", h.Type)
+		}
+		if c.Hooks[i].Name == "" {
+			c.Hooks[i].Name = c.Hooks[i].Type
+			if u, err := url.Parse(h.URL); err == nil && u.Host != "" {
+				c.Hooks[i].Name = u.Host
+			}
+		}
+	}
+	return c, nil
+}
+
+// backendState tracks a single backend between its health transitions
+type backendState struct {
+	healthy   bool
+	notified  bool
+	downSince time.Time
+	timer     *time.Timer
+}
+
+// Notifier fires the webhooks on health transitions of backends
+type Notifier struct {
+	Config
+	// Backoff is the delay before the first retry, it doubles with each retry
+	Backoff time.Duration
+	// LogSize is the number of deliveries kept in the log
+	LogSize int
+
+	client *http.Client
+	mu     sync.Mutex
+	states map[string]*backendState
+	log    []Delivery
+}
+
+// New returns a notifier for the given config
+func New(c Config) *Notifier {
+	return &Notifier{
+		Config:  c,
+		Backoff: time.Second,
+		LogSize: 100,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		states:  map[string]*backendState{},
+	}
+}
+
+// BackendChanged is called for every health transition of a backend. Down
+// notifications are sent once the backend was down for MinDown and Debounce,
+// recoveries only if the down was notified and the backend stays up for Debounce.
+// Unknown backends count as up, so a backend which is down on its first check
+// is notified like any other.
+func (n *Notifier) BackendChanged(id string, b config.Backend) {
+	key := id + " " + b.URL
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.states[key]
+	if !ok {
+		s = &backendState{healthy: true}
+		n.states[key] = s
+	}
+	if s.healthy == b.Healthy {
+		return
+	}
+	s.healthy = b.Healthy
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	e := Event{Entry: id, Name: strings.SplitN(id, "_", 2)[0], Backend: b.URL, StatusCode: b.StatusCode, Error: b.Error}
+
+	if !b.Healthy {
+		if s.notified {
+			// flapped back down before the recovery was sent
+			return
+		}
+		s.downSince = time.Now()
+		wait := n.MinDown
+		if n.Debounce > wait {
+			wait = n.Debounce
+		}
+		s.timer = time.AfterFunc(wait, func() {
+			n.mu.Lock()
+			if s.healthy || s.notified {
+				n.mu.Unlock()
+				return
+			}
+			s.notified = true
+			since := s.downSince
+			n.mu.Unlock()
+			e.Event, e.DownSince, e.Time = "down", &since, time.Now()
+			n.send(e)
+		})
+		return
+	}
+
+	if !s.notified {
+		// recovered before the down was sent
+		return
+	}
+	s.timer = time.AfterFunc(n.Debounce, func() {
+		n.mu.Lock()
+		if !s.healthy || !s.notified {
+			n.mu.Unlock()
+			return
+		}
+		s.notified = false
+		since := s.downSince
+		n.mu.Unlock()
+		e.Event, e.DownSince, e.Time = "up", &since, time.Now()
+		n.send(e)
+	})
+}
+
+// Forget drops the state of all backends of a deleted entry, pending
+// notifications are not sent anymore
+func (n *Notifier) Forget(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, s := range n.states {
+		if strings.HasPrefix(key, id+" ") {
+			if s.timer != nil {
+				s.timer.Stop()
+			}
+			delete(n.states, key)
+		}
+	}
+}
+
+// send delivers the event to all hooks concurrently
+func (n *Notifier) send(e Event) {
+	for _, h := range n.Hooks {
+		go n.deliver(h, e)
+	}
+}
+
+// deliver sends the event to the hook, retrying with exponential backoff
+func (n *Notifier) deliver(h Hook, e Event) {
+	d := Delivery{Hook: h.Name, Event: e}
+	backoff := n.Backoff
+	for d.Attempts = 1; ; d.Attempts++ {
+		d.Status, d.Success, d.Error = 0, false, ""
+		req, err := request(h, e)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = n.client.Do(req); err == nil {
+				resp.Body.Close()
+				d.Status = resp.StatusCode
+				if resp.StatusCode >= 300 {
+					err = fmt.Errorf("unexpected status %s", resp.Status)
+				}
+			}
+		}
+		if err == nil {
+			d.Success = true
+			break
+		}
+		d.Error = err.Error()
+		if d.Attempts > n.Retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	d.Time = time.Now()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.log = append(n.log, d)
+	if len(n.log) > n.LogSize {
+		n.log = n.log[len(n.log)-n.LogSize:]
+	}
+}
+
+// request builds the http request for the type of the hook
+func request(h Hook, e Event) (*http.Request, error) {
+	var (
+		req *http.Request
+		err error
+	)
+	title := fmt.Sprintf("%s is %s", e.Name, e.Event)
+	msg := fmt.Sprintf("Backend %s of %s is down", e.Backend, e.Name)
+	if e.Error != "" {
+		msg += ": " + e.Error
+	}
+	if e.Event == "up" {
+		msg = fmt.Sprintf("Backend %s of %s recovered after %s", e.Backend, e.Name, e.Time.Sub(*e.DownSince).Round(time.Second))
+	}
+
+	switch h.Type {
+	case TypeNtfy:
+		if req, err = http.NewRequest("POST", h.URL, strings.NewReader(msg)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Title", title)
+		if e.Event == "down" {
+			req.Header.Set("Priority", "high")
+			req.Header.Set("Tags", "rotating_light")
+		} else {
+			req.Header.Set("Tags", "white_check_mark")
+		}
+		if h.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+h.Token)
+		}
+	case TypeGotify:
+		priority := 5
+		if e.Event == "down" {
+			priority = 8
+		}
+		b, _ := json.Marshal(map[string]interface{}{"title": title, "message": msg, "priority": priority})
+		u := h.URL
+		if !strings.HasSuffix(u, "/message") {
+			u = strings.TrimSuffix(u, "/") + "/message"
+		}
+		if req, err = http.NewRequest("POST", u, bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", h.Token)
+	default:
+		b, _ := json.Marshal(e)
+		if req, err = http.NewRequest("POST", h.URL, bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if h.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+h.Token)
+		}
+	}
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// Deliveries returns the delivery log, newest first
+func (n *Notifier) Deliveries() []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dl := make([]Delivery, len(n.log))
+	for i, d := range n.log {
+		dl[len(n.log)-1-i] = d
+	}
+	return dl
+}
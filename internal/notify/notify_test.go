@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+)
+
+func TestNotifier(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []Event
+		fails  = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		events = append(events, e)
+	}))
+	defer srv.Close()
+
+	n := New(Config{Debounce: 20 * time.Millisecond, MinDown: 50 * time.Millisecond, Retries: 2, Hooks: []Hook{{Name: "test", Type: TypeGeneric, URL: srv.URL}}})
+	n.Backoff = time.Millisecond
+	down := config.Backend{URL: "http://backend:80", Healthy: false, Error: "refused"}
+	up := config.Backend{URL: "http://backend:80", Healthy: true}
+
+	// short outages are not notified
+	n.BackendChanged("Test_01234567", down)
+	time.Sleep(10 * time.Millisecond)
+	n.BackendChanged("Test_01234567", up)
+	time.Sleep(100 * time.Millisecond)
+	if d := n.Deliveries(); len(d) != 0 {
+		t.Fatalf("Short outage should not be notified %+v", d)
+	}
+
+	n.BackendChanged("Test_01234567", down)
+	time.Sleep(100 * time.Millisecond)
+	n.BackendChanged("Test_01234567", up)
+	time.Sleep(100 * time.Millisecond)
+
+	d := n.Deliveries()
+	if len(d) != 2 || d[0].Event.Event != "up" || d[1].Event.Event != "down" {
+		t.Fatalf("Wrong deliveries %+v", d)
+	}
+	if !d[1].Success || d[1].Attempts != 2 || d[1].Status != 200 {
+		t.Errorf("Down should be retried %+v", d[1])
+	}
+
+	// deleted entries are not notified anymore
+	n.BackendChanged("Test_01234567", down)
+	n.Forget("Test_01234567")
+	time.Sleep(100 * time.Millisecond)
+	if d = n.Deliveries(); len(d) != 2 || len(n.states) != 0 {
+		t.Errorf("Forgotten entry should not be notified %+v", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 || events[0].Name != "Test" || events[0].Error != "refused" || events[0].DownSince == nil {
+		t.Errorf("Wrong payloads %+v", events)
+	}
+}
+
+func TestDownOnStart(t *testing.T) {
+	var mu sync.Mutex
+	events := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e.Event+" "+e.Entry)
+	}))
+	defer srv.Close()
+
+	n := New(Config{Debounce: 10 * time.Millisecond, MinDown: 50 * time.Millisecond, Hooks: []Hook{{Name: "test", URL: srv.URL}}})
+	// the first observation of both backends is down, only one stays down
+	n.BackendChanged("Test_01234567", config.Backend{URL: "http://backend:80", Error: "refused"})
+	n.BackendChanged("Other_01234567", config.Backend{URL: "http://backend:80", Error: "refused"})
+	time.Sleep(10 * time.Millisecond)
+	n.BackendChanged("Other_01234567", config.Backend{URL: "http://backend:80", Healthy: true})
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0] != "down Test_01234567" {
+		t.Errorf("Backend down from the start should be notified after MinDown %v", events)
+	}
+}
+
+func TestRequest(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	e := Event{Event: "up", Name: "Test", Backend: "http://backend:80", DownSince: &since, Time: time.Now()}
+	req, err := request(Hook{Type: TypeGotify, URL: "https://gotify.example.com/", Token: "secret"}, e)
+	if err != nil || req.URL.String() != "https://gotify.example.com/message" || req.Header.Get("X-Gotify-Key") != "secret" {
+		t.Errorf("Wrong gotify request %v %v", req, err)
+	}
+	h := Hook{Name: "ntfy.sh", Type: TypeNtfy, URL: "https://ntfy.sh/topic"}
+	req, err = request(h, e)
+	if err != nil || req.Header.Get("Title") != "Test is up" || req.Header.Get("Authorization") != "" {
+		t.Errorf("Wrong ntfy request %v %v", req, err)
+	}
+	if b, _ := json.Marshal(h); strings.Contains(string(b), "topic") {
+		t.Errorf("Hook url should not be exposed %s", b)
+	}
+}
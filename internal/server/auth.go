@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/indieauth"
+	"github.com/pheelee/traefik-admin/logger"
+)
+
+// Authenticator is a login provider protecting the admin ui and the entries
+// using forward auth
+type Authenticator interface {
+	// Check returns true if the request belongs to a session with a valid login
+	Check(r *http.Request) bool
+	// Me returns the identity of the logged in user or an empty string
+	Me(r *http.Request) string
+	// Redirect starts the login by redirecting to the provider
+	Redirect(w http.ResponseWriter, r *http.Request) error
+	// RedirectHandler completes the login when the provider redirects back
+	RedirectHandler(w http.ResponseWriter, r *http.Request)
+	// CallbackPath is the path the RedirectHandler is served at
+	CallbackPath() string
+	// Logout ends the session of the user
+	Logout(w http.ResponseWriter, r *http.Request)
+}
+
+// Identity headers are returned by the forward auth on success, traefik passes
+// them to the backend if they are listed in authResponseHeaders
+const (
+	HeaderUser   = "X-Forwarded-User"
+	HeaderGroups = "X-Forwarded-Groups"
+)
+
+// IdentityHeaders are the headers the sys-forwardauth middleware has to pass on
+var IdentityHeaders = []string{HeaderUser, HeaderGroups}
+
+// authenticators creates the providers selectable with Config.AuthProvider
+var authenticators = map[string]func(cfg Config) (Authenticator, error){
+	"indieauth": newIndieAuth,
+}
+
+// AuthProviders returns the names of the available providers
+func AuthProviders() []string {
+	names := []string{}
+	for n := range authenticators {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AuthEnabled returns true if the selected provider is configured
+func (c Config) AuthEnabled() bool {
+	switch c.AuthProvider {
+	case "", "indieauth":
+		return c.AuthorizationEndpoint != ""
+	}
+	// unknown providers fail in SetupRoutes instead of silently disabling auth
+	return true
+}
+
+func newAuthenticator(cfg Config) (Authenticator, error) {
+	if cfg.AuthProvider == "" {
+		cfg.AuthProvider = "indieauth"
+	}
+	create, ok := authenticators[cfg.AuthProvider]
+	if !ok {
+		return nil, fmt.Errorf("unknown auth provider %s, use one of %s", cfg.AuthProvider, strings.Join(AuthProviders(), ", "))
+	}
+	return create(cfg)
+}
+
+func newIndieAuth(cfg Config) (Authenticator, error) {
+	store := sessions.NewCookieStore([]byte(cfg.CookieSecret))
+	ia, err := indieauth.New(store, "http://localhost/endpoints", cfg.AuthorizationEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	// logins survive restarts and work across replicas sharing the secret
+	key := sha256.Sum256([]byte("indieauth-state:" + cfg.CookieSecret))
+	ia.StateKey = key[:]
+	ia.OnLogin = observeAuth(authLogins)
+	ia.Allowed = cfg.AllowedUsers
+	ia.Forbidden = forbidden
+	return ia, nil
+}
+
+var forbiddenPage = template.Must(template.ParseFS(efs, "webrootSrc/forbidden.html"))
+
+// forbidden renders the page for rejected logins, me is empty if the provider
+// rejected the login itself
+func forbidden(w http.ResponseWriter, r *http.Request, me string) {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	forbiddenPage.Execute(w, struct{ Me, Host string }{me, host})
+}
+
+// checked counts the forward auth checks, requests without a login fail in
+// requireLogin and the others after the access policy in verify
+var checked = observeAuth(authChecks)
+
+// requireLogin passes requests with a valid login and starts the login
+// otherwise. Rejected logins are answered by the provider in its callback and
+// rejected identities by the access policies in verify.
+func requireLogin(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if a.Check(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			checked(false)
+			if err := a.Redirect(w, r); err != nil {
+				logger.Error(fmt.Sprintf("login redirect failed: %s", err))
+				http.Error(w, "login failed", http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+// verify answers the forward auth of logged in users, the access policies of
+// the entries matching the forwarded host and uri decide if they may pass
+func verify(w http.ResponseWriter, r *http.Request) {
+	a, err := config.Manager.Access()
+	if err != nil {
+		panic(err)
+	}
+	ids, err := config.Manager.EntriesOf(r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Uri"))
+	if err != nil {
+		panic(err)
+	}
+	me := auth.Me(r)
+	for _, id := range ids {
+		if !a.Allowed(id, me, nil) {
+			checked(false)
+			forbidden(w, r, me)
+			return
+		}
+	}
+	checked(true)
+	w.Header().Set(HeaderUser, me)
+	if groups := a.GroupsOf(me, nil); len(groups) > 0 {
+		sort.Strings(groups)
+		w.Header().Set(HeaderGroups, strings.Join(groups, ","))
+	}
+	w.Write([]byte("authorized"))
+}
+
+// GetAccess returns the groups and the policies of all entries
+func GetAccess(w http.ResponseWriter, r *http.Request) {
+	a, err := config.Manager.Access()
+	if err != nil {
+		panic(err)
+	}
+	b, err := json.Marshal(a)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// SaveAccess replaces the groups and the policies of all entries
+func SaveAccess(w http.ResponseWriter, r *http.Request) {
+	var a config.Access
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := config.Manager.SaveAccess(&a); err != nil {
+		panic(err)
+	}
+	GetAccess(w, r)
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/indieauth"
+)
+
+// fakeAuth is a login provider with a fixed identity, an empty me is not
+// logged in
+type fakeAuth struct {
+	me       string
+	redirect error
+}
+
+func (f *fakeAuth) Check(r *http.Request) bool { return f.me != "" }
+func (f *fakeAuth) Me(r *http.Request) string  { return f.me }
+func (f *fakeAuth) Redirect(w http.ResponseWriter, r *http.Request) error {
+	if f.redirect == nil {
+		http.Redirect(w, r, "https://auth.example.com/", http.StatusTemporaryRedirect)
+	}
+	return f.redirect
+}
+func (f *fakeAuth) RedirectHandler(w http.ResponseWriter, r *http.Request) {}
+func (f *fakeAuth) CallbackPath() string                                   { return "/callback" }
+func (f *fakeAuth) Logout(w http.ResponseWriter, r *http.Request)          {}
+
+func TestAuthenticators(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		enabled bool
+		err     bool
+	}{
+		{Config{}, false, false},
+		{Config{AuthorizationEndpoint: "https://auth.example.com/authorize"}, true, false},
+		{Config{AuthProvider: "indieauth", AuthorizationEndpoint: "https://auth.example.com/authorize"}, true, false},
+		{Config{AuthProvider: "indieauth"}, false, false},
+		{Config{AuthProvider: "other"}, true, true},
+	}
+	for _, tt := range tests {
+		if tt.cfg.AuthEnabled() != tt.enabled {
+			t.Errorf("%+v should be enabled %v", tt.cfg, tt.enabled)
+		}
+		if !tt.enabled {
+			continue
+		}
+		a, err := newAuthenticator(tt.cfg)
+		if (err != nil) != tt.err {
+			t.Errorf("%+v should fail %v, got %v", tt.cfg, tt.err, err)
+		}
+		if _, ok := a.(*indieauth.IndieAuth); err == nil && !ok {
+			t.Errorf("%+v should select indieauth, got %T", tt.cfg, a)
+		}
+	}
+	if p := AuthProviders(); len(p) != 1 || p[0] != "indieauth" {
+		t.Errorf("Wrong providers %v", p)
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	serve := func(a Authenticator) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		requireLogin(a)(next).ServeHTTP(w, httptest.NewRequest("GET", "/auth/verify", nil))
+		return w
+	}
+	if w := serve(&fakeAuth{me: "https://alice.example.com/"}); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("Logged in users should pass %d", w.Code)
+	}
+	if w := serve(&fakeAuth{}); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Should start the login %d", w.Code)
+	}
+	if w := serve(&fakeAuth{redirect: errors.New("broken")}); w.Code != http.StatusInternalServerError {
+		t.Errorf("Failed redirects should answer 500, got %d", w.Code)
+	}
+}
+
+func TestForbiddenLogin(t *testing.T) {
+	status := http.StatusOK
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"me": "https://bob.example.com/"}`))
+	}))
+	defer endpoint.Close()
+	a, err := newAuthenticator(Config{
+		AuthorizationEndpoint: endpoint.URL,
+		AllowedUsers:          []string{"https://alice.example.com/"},
+		CookieSecret:          "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// login starts the login on a protected page and completes it in the callback
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/auth/verify", nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "grafana.example.com")
+		requireLogin(a)(http.NotFoundHandler()).ServeHTTP(w, r)
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("Should start the login %d", w.Code)
+		}
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		cb := httptest.NewRequest("GET", a.CallbackPath()+"?code=abc&state="+url.QueryEscape(loc.Query().Get("state")), nil)
+		cb.Header.Set("X-Forwarded-Host", "grafana.example.com")
+		for _, c := range w.Result().Cookies() {
+			cb.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		a.RedirectHandler(w, cb)
+		return w
+	}
+	if w := login(); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "https://bob.example.com/") {
+		t.Errorf("Bob should be rejected with the forbidden page %d %s", w.Code, w.Body.String())
+	}
+	status = http.StatusForbidden
+	if w := login(); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "did not allow the login to grafana.example.com") {
+		t.Errorf("Logins rejected by the endpoint should answer the forbidden page %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	config.Manager = config.ConfigManager{Path: dir, CertResolver: "http01", AccessPath: path.Join(t.TempDir(), "access.yaml")}
+	defer func() { config.Manager = config.ConfigManager{} }()
+	add := func(name string, rule config.Rule, allow ...string) *config.Config {
+		c, err := config.Manager.Add(&config.UserInput{
+			Name:         name,
+			Rule:         rule,
+			Backends:     []config.Backend{{URL: "http://1.2.3.4:80"}},
+			ForwardAuth:  true,
+			AccessPolicy: &config.AccessPolicy{Allow: allow},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	add("Grafana", config.Rule{Hosts: []string{"grafana.example.com"}}, "@admins")
+	add("Public", config.Rule{Hosts: []string{"grafana.example.com"}, PathPrefix: []string{"/public"}})
+	if err := config.Manager.SaveAccess(&config.Access{
+		Groups:   map[string][]string{"admins": {"https://alice.example.com/"}},
+		Policies: mustAccess(t).Policies,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(me string, uri string) *httptest.ResponseRecorder {
+		auth = &fakeAuth{me: me}
+		r := httptest.NewRequest("GET", "/auth/verify", nil)
+		r.Header.Set("X-Forwarded-Host", "grafana.example.com")
+		r.Header.Set("X-Forwarded-Uri", uri)
+		w := httptest.NewRecorder()
+		requireLogin(auth)(http.HandlerFunc(verify)).ServeHTTP(w, r)
+		return w
+	}
+	w := serve("https://alice.example.com/", "/dashboards")
+	if w.Code != http.StatusOK || w.Header().Get(HeaderUser) != "https://alice.example.com/" || w.Header().Get(HeaderGroups) != "admins" {
+		t.Errorf("Alice should pass with her identity %d %v", w.Code, w.Header())
+	}
+	w = serve("https://bob.example.com/", "/dashboards")
+	if w.Code != http.StatusForbidden || w.Header().Get(HeaderUser) != "" {
+		t.Errorf("Bob should be rejected by the policy %d %v", w.Code, w.Header())
+	}
+	w = serve("https://bob.example.com/", "/public/logo.png")
+	if w.Code != http.StatusOK || w.Header().Get(HeaderUser) != "https://bob.example.com/" || w.Header().Get(HeaderGroups) != "" {
+		t.Errorf("Bob should pass the entry without policy %d %v", w.Code, w.Header())
+	}
+}
+
+func mustAccess(t *testing.T) *config.Access {
+	a, err := config.Manager.Access()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
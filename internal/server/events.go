@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+)
+
+// sseEvent is a single message of the /events stream
+type sseEvent struct {
+	Name string
+	Data interface{}
+}
+
+// healthEvent is published when a backend of an entry becomes healthy or unhealthy
+type healthEvent struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Healthy    bool   `json:"healthy"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// broker fans out events to all connected /events clients
+type broker struct {
+	sync.Mutex
+	subscribers map[chan sseEvent]struct{}
+}
+
+var events = &broker{subscribers: map[chan sseEvent]struct{}{}}
+
+func (b *broker) subscribe() (chan sseEvent, func()) {
+	ch := make(chan sseEvent, 16)
+	b.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.Unlock()
+	return ch, func() {
+		b.Lock()
+		delete(b.subscribers, ch)
+		b.Unlock()
+	}
+}
+
+// publish sends the event to all clients, slow clients miss events instead of
+// blocking the publisher
+func (b *broker) publish(name string, data interface{}) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- sseEvent{Name: name, Data: data}:
+		default:
+		}
+	}
+}
+
+// backendHealth publishes the health transition of a backend
+func backendHealth(id string, backend config.Backend) {
+	events.publish("health", healthEvent{
+		ID:         id,
+		URL:        backend.URL,
+		Healthy:    backend.Healthy,
+		StatusCode: backend.StatusCode,
+		Error:      backend.Error,
+	})
+}
+
+// forwardConfigEvents publishes the changes of the watched config directory
+// and checks new or changed entries right away
+func forwardConfigEvents() {
+	ch, _ := config.Manager.Subscribe()
+	if ch == nil {
+		return
+	}
+	go func() {
+		for e := range ch {
+			events.publish("entry", e)
+			if e.Type == config.EventDeleted {
+				forgetEntry(e.ID)
+				notifier.Forget(e.ID)
+			} else {
+				go checkEntry(e.ID)
+			}
+		}
+	}()
+}
+
+// checkEntry runs the health check of a single http entry
+func checkEntry(id string) {
+	c := config.Manager.Get(id)
+	if c == nil || c.Protocol() != "" {
+		return
+	}
+	if u, err := c.ToUserInput(); err == nil {
+		health.Check(u)
+	}
+}
+
+// Events streams entry changes and backend health transitions as server-sent events
+func Events(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel := events.subscribe()
+	defer cancel()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	// disable buffering of reverse proxies like the home assistant ingress
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			b, err := json.Marshal(e.Data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, b)
+		}
+		f.Flush()
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/monitor"
+)
+
+// subscribers returns the number of connected /events clients
+func subscribers() int {
+	events.Lock()
+	defer events.Unlock()
+	return len(events.subscribers)
+}
+
+func TestEvents(t *testing.T) {
+	config.Manager = config.ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	defer func() { config.Manager = config.ConfigManager{} }()
+	if err := config.Manager.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer config.Manager.Close()
+	health = monitor.New(time.Minute, 10)
+	forwardConfigEvents()
+
+	srv := httptest.NewServer(http.HandlerFunc(Events))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events", nil)
+	// the headers only arrive if the handler flushes them before the first event
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("content-type"); ct != "text/event-stream" {
+		t.Errorf("Wrong content type %s", ct)
+	}
+	if n := subscribers(); n != 1 {
+		t.Fatalf("Client should be subscribed, got %d", n)
+	}
+
+	frames := make(chan string, 16)
+	go func() {
+		name := ""
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			switch l := s.Text(); {
+			case strings.HasPrefix(l, "event: "):
+				name = strings.TrimPrefix(l, "event: ")
+			case strings.HasPrefix(l, "data: ") && name == "entry":
+				frames <- strings.TrimPrefix(l, "data: ")
+			}
+		}
+	}()
+
+	c, err := config.Manager.Add(&config.UserInput{Name: "Test", Domain: "test.example.com", Backends: []config.Backend{{URL: "http://127.0.0.1:1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-frames:
+		var e config.Event
+		if err = json.Unmarshal([]byte(f), &e); err != nil || e.Type != config.EventCreated || e.ID != c.ID() {
+			t.Errorf("Wrong event %s %v", f, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No entry event")
+	}
+
+	cancel()
+	for i := 0; subscribers() != 0; i++ {
+		if i == 50 {
+			t.Fatal("Client should be unsubscribed after disconnecting")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
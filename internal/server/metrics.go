@@ -0,0 +1,153 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "traefik_admin"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of handled http requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the http requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_check_duration_seconds",
+		Help:      "Duration of the health check of the slowest backend of an entry.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"entry"})
+
+	configWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_write_failures_total",
+		Help:      "Number of failed writes of the dynamic config by operation.",
+	}, []string{"operation"})
+
+	authChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_checks_total",
+		Help:      "Number of forward auth checks by result.",
+	}, []string{"result"})
+
+	authLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_logins_total",
+		Help:      "Number of completed logins by result.",
+	}, []string{"result"})
+)
+
+// registerState registers the state collector once, the routes may be set up
+// more than once
+var registerState sync.Once
+
+// stateCollector reports the entries and the backend health at scrape time,
+// so deleted entries disappear without bookkeeping. The monitor is looked up
+// on every scrape as it is replaced when the routes are set up again.
+type stateCollector struct {
+	monitor func() *monitor.Monitor
+	entries *prometheus.Desc
+	up      *prometheus.Desc
+}
+
+func newStateCollector(m func() *monitor.Monitor) *stateCollector {
+	return &stateCollector{
+		monitor: m,
+		entries: prometheus.NewDesc(metricsNamespace+"_entries", "Number of proxy and stream entries.", nil, nil),
+		up:      prometheus.NewDesc(metricsNamespace+"_backend_up", "Whether the last health check of the backend succeeded.", []string{"entry", "backend"}, nil),
+	}
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+	ch <- c.up
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	if cl, err := config.Manager.List(); err == nil {
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(len(cl)))
+	}
+	m := c.monitor()
+	if m == nil {
+		return
+	}
+	for id, bl := range m.Backends() {
+		for _, b := range bl {
+			up := 0.0
+			if b.Healthy {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, id, b.URL)
+		}
+	}
+}
+
+// observeCheck records the latency of a health check
+func observeCheck(id string, r monitor.Result) {
+	checkDuration.WithLabelValues(id).Observe(r.Latency / 1000)
+}
+
+// forgetEntry removes the series of a deleted entry
+func forgetEntry(id string) {
+	checkDuration.DeletePartialMatch(prometheus.Labels{"entry": id})
+}
+
+// FailedWrite counts a config write which failed because of the filesystem, it
+// is the OnWriteFailure hook of the config manager
+func FailedWrite(operation string) {
+	configWriteFailures.WithLabelValues(operation).Inc()
+}
+
+// observeAuth counts the result of a forward auth check or a login
+func observeAuth(counter *prometheus.CounterVec) func(bool) {
+	return func(ok bool) {
+		result := "failure"
+		if ok {
+			result = "success"
+		}
+		counter.WithLabelValues(result).Inc()
+	}
+}
+
+// instrumentUnmatched counts the requests which do not match a route as well, the
+// middlewares of the router only run for matched routes
+func instrumentUnmatched(r *mux.Router) {
+	r.NotFoundHandler = instrument(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+}
+
+// instrument counts the requests and their duration by the matched route
+// template, so ids do not end up in the labels
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if t, err := cr.GetPathTemplate(); err == nil {
+				route = t
+			}
+		}
+		m := httpsnoop.CaptureMetrics(next, w, r)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(m.Code)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(m.Duration.Seconds())
+	})
+}
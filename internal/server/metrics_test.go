@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/monitor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape returns the samples of the metrics endpoint by series
+func scrape(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	samples := map[string]float64{}
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		l := s.Text()
+		i := strings.LastIndex(l, " ")
+		if strings.HasPrefix(l, "#") || i == -1 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(l[i+1:], 64); err == nil {
+			samples[l[:i]] = v
+		}
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	config.Manager = config.ConfigManager{Path: t.TempDir(), CertResolver: "http01", AccessPath: path.Join(t.TempDir(), "access.yaml")}
+	defer func() { config.Manager = config.ConfigManager{} }()
+	backend := httptest.NewServer(http.NotFoundHandler())
+	defer backend.Close()
+	c, err := config.Manager.Add(&config.UserInput{
+		Name:         "Grafana",
+		Domain:       "grafana.example.com",
+		Backends:     []config.Backend{{URL: backend.URL}},
+		ForwardAuth:  true,
+		AccessPolicy: &config.AccessPolicy{Allow: []string{"https://alice.example.com/"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := c.ToUserInput()
+
+	m := monitor.New(time.Minute, 10)
+	m.OnCheck = observeCheck
+	m.Check(u)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(newStateCollector(func() *monitor.Monitor { return m }))
+
+	auth = &fakeAuth{me: "https://bob.example.com/"}
+	r := mux.NewRouter()
+	r.Use(instrument)
+	instrumentUnmatched(r)
+	r.HandleFunc("/config/", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	r.Handle("/auth/verify", requireLogin(auth)(http.HandlerFunc(verify)))
+	r.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, reg}, promhttp.HandlerOpts{}))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	before := scrape(t, srv.URL)
+	req, _ := http.NewRequest("GET", srv.URL+"/auth/verify", nil)
+	req.Header.Set("X-Forwarded-Host", "grafana.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Bob should be rejected %d", resp.StatusCode)
+	}
+	http.Get(srv.URL + "/missing")
+	http.Post(srv.URL+"/config/", "application/json", nil)
+	after := scrape(t, srv.URL)
+
+	delta := func(series string) float64 { return after[series] - before[series] }
+	if d := delta(`traefik_admin_auth_checks_total{result="failure"}`); d != 1 {
+		t.Errorf("Policy rejection should count as failed check, got %v", d)
+	}
+	if d := delta(`traefik_admin_auth_checks_total{result="success"}`); d != 0 {
+		t.Errorf("Policy rejection should not count as success, got %v", d)
+	}
+	if d := delta(`traefik_admin_http_requests_total{code="403",method="GET",route="/auth/verify"}`); d != 1 {
+		t.Errorf("Request should be counted by route, got %v", d)
+	}
+	if d := delta(`traefik_admin_http_requests_total{code="404",method="GET",route="unknown"}`); d != 1 {
+		t.Errorf("Unmatched requests should be counted, got %v", d)
+	}
+	if d := delta(`traefik_admin_http_requests_total{code="405",method="POST",route="unknown"}`); d != 1 {
+		t.Errorf("Requests with the wrong method should be counted, got %v", d)
+	}
+	if after[`traefik_admin_entries`] != 1 {
+		t.Errorf("Should report one entry %v", after[`traefik_admin_entries`])
+	}
+	if v, ok := after[`traefik_admin_backend_up{backend="`+backend.URL+`",entry="`+c.ID()+`"}`]; !ok || v != 1 {
+		t.Errorf("Backend should be up %v %v", v, ok)
+	}
+	if after[`traefik_admin_backend_check_duration_seconds_count{entry="`+c.ID()+`"}`] < 1 {
+		t.Errorf("Check duration should be observed")
+	}
+}
+
+func TestSetupRoutesTwice(t *testing.T) {
+	config.Manager = config.ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	defer func() { config.Manager = config.ConfigManager{} }()
+	defer func() {
+		if err := recover(); err != nil {
+			t.Errorf("Setting up the routes again should not panic %v", err)
+		}
+	}()
+	SetupRoutes(Config{HealthInterval: time.Minute})
+	SetupRoutes(Config{HealthInterval: time.Minute})
+}
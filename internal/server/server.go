@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"crypto/sha256"
 	"embed"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -13,13 +15,16 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 	"github.com/pheelee/traefik-admin/config"
-	"github.com/pheelee/traefik-admin/internal/indieauth"
+	"github.com/pheelee/traefik-admin/internal/monitor"
+	"github.com/pheelee/traefik-admin/internal/notify"
 	"github.com/pheelee/traefik-admin/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var VERSION string
@@ -29,14 +34,23 @@ var efs embed.FS
 
 var appcfg Config
 
-var cookieStore *sessions.CookieStore
+var auth Authenticator
+
+var health *monitor.Monitor
+
+var notifier *notify.Notifier
 
 var assetHashes sync.Map
 
 type Config struct {
 	WebRoot               string
+	AuthProvider          string
 	AuthorizationEndpoint string
+	AllowedUsers          []string
 	CookieSecret          string
+	HealthInterval        time.Duration
+	HealthProbe           config.Probe
+	Webhooks              notify.Config
 }
 
 func List(w http.ResponseWriter, r *http.Request) {
@@ -50,16 +64,10 @@ func List(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	// perform health checks
-	var wg sync.WaitGroup
-	for i, _ := range configList {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, b *config.Backend) {
-			defer wg.Done()
-			b.Connect()
-		}(&wg, &configList[i].Backend)
+	// health is checked in the background
+	for i := range configList {
+		health.Apply(&configList[i])
 	}
-	wg.Wait()
 
 	if b, err = json.Marshal(configList); err != nil {
 		panic(err)
@@ -84,9 +92,65 @@ func Get(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 	w.Header().Set("content-type", "application/json")
+	w.Header().Set("ETag", etag(cfg.Revision()))
+	w.Write(b)
+}
+
+// manager returns the config manager acting in the name of the logged in user
+func manager(r *http.Request) *config.ConfigManager {
+	if auth == nil {
+		return config.Manager.As("")
+	}
+	return config.Manager.As(auth.Me(r))
+}
+
+// etag formats a config revision as strong entity tag
+func etag(revision string) string {
+	return `"` + revision + `"`
+}
+
+// ifMatch returns the revision of the If-Match header or an empty string
+func ifMatch(r *http.Request) string {
+	return strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+}
+
+// conflict answers the request with 409 if err is a revision conflict
+func conflict(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, config.ErrConflict) {
+		return false
+	}
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusConflict)
 	w.Write(b)
+	return true
 }
 
+// notFound answers the request with 404 if err is a missing entry
+func notFound(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, config.ErrNotFound) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotFound)
+	return true
+}
+
+// revisionRequired answers the request with 428 if the change is not based on
+// a revision, sent as If-Match header or in the body. Without it a change
+// would silently overwrite the edits of others.
+func revisionRequired(w http.ResponseWriter, revision string) bool {
+	if revision != "" {
+		return false
+	}
+	b, _ := json.Marshal(map[string]string{"error": "the revision of the entry is required, send it as If-Match header"})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusPreconditionRequired)
+	w.Write(b)
+	return true
+}
+
+// Save creates an entry with POST and updates it with PUT, updates have to
+// carry the revision they are based on
 func Save(w http.ResponseWriter, r *http.Request) {
 
 	var (
@@ -128,11 +192,30 @@ func Save(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "POST":
-		c, err = config.Manager.Add(u)
+		c, err = manager(r).Add(u)
 	case "PUT":
-		c, err = config.Manager.Update(u)
+		if rev := ifMatch(r); rev != "" {
+			u.Revision = rev
+		}
+		if revisionRequired(w, u.Revision) {
+			return
+		}
+		c, err = manager(r).Update(u)
 	}
 
+	if conflict(w, err) || notFound(w, err) {
+		return
+	}
+	var dc *config.DomainConflict
+	if errors.As(err, &dc) {
+		v = config.NewValidation()
+		v.Valid = false
+		v.Errors.Domain = dc.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ = json.Marshal(v)
+		w.Write(b)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -140,16 +223,308 @@ func Save(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		panic(err)
 	}
-	u.Backend.Connect()
+	w.Header().Set("ETag", etag(c.Revision()))
+	health.Check(u)
 	b, _ = json.Marshal(u)
 	w.Write(b)
 }
 
+func ListStreams(w http.ResponseWriter, r *http.Request) {
+	streamList, err := config.Manager.ListStreamInputs()
+	if err != nil {
+		panic(err)
+	}
+	b, err := json.Marshal(streamList)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// SaveStream creates a tcp or udp entry with POST and updates it with PUT,
+// updates have to carry the revision they are based on
+func SaveStream(w http.ResponseWriter, r *http.Request) {
+	var (
+		b   []byte
+		err error
+		s   *config.StreamInput
+		c   *config.Config
+		v   config.StreamValidation
+	)
+	w.Header().Set("content-type", "application/json")
+
+	// Parse User input
+	b, err = ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err == nil {
+		err = json.Unmarshal(b, &s)
+	}
+	if err != nil || s == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ = json.Marshal(v)
+		logger.Error(err)
+		w.Write(b)
+		return
+	}
+
+	// Validate user input
+	if v = s.Validate(); !v.Valid {
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ = json.Marshal(v)
+		w.Write(b)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		c, err = manager(r).AddStream(s)
+	case "PUT":
+		if rev := ifMatch(r); rev != "" {
+			s.Revision = rev
+		}
+		if revisionRequired(w, s.Revision) {
+			return
+		}
+		c, err = manager(r).UpdateStream(s)
+	}
+
+	if conflict(w, err) || notFound(w, err) {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("ETag", etag(c.Revision()))
+	s, err = c.ToStreamInput()
+	if err != nil {
+		panic(err)
+	}
+	b, _ = json.Marshal(s)
+	w.Write(b)
+}
+
+// Delete removes the entry, the revision to delete is sent as If-Match header
 func Delete(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
-	if err := config.Manager.Delete(id); err != nil {
+	rev := ifMatch(r)
+	if revisionRequired(w, rev) {
+		return
+	}
+	err := manager(r).Delete(id, rev)
+	if conflict(w, err) || notFound(w, err) {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Export returns all entries as json or, with format=yaml, as yaml bundle
+func Export(w http.ResponseWriter, r *http.Request) {
+	bundle, err := config.Manager.Export()
+	if err != nil {
+		panic(err)
+	}
+	var b []byte
+	if r.URL.Query().Get("format") == "yaml" {
+		b, err = bundle.YAML()
+		w.Header().Set("content-type", "application/yaml")
+		w.Header().Set("content-disposition", `attachment; filename="traefik-admin.yaml"`)
+	} else {
+		b, err = json.Marshal(bundle)
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("content-disposition", `attachment; filename="traefik-admin.json"`)
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.Write(b)
+}
+
+// Import applies a json or yaml bundle, the mode query parameter selects merge
+// (default) or replace and dryRun=true only returns the planned changes
+func Import(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	var bundle *config.Bundle
+	if err == nil {
+		bundle, err = config.ParseBundle(b)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+		w.Write(b)
+		return
+	}
+	q := r.URL.Query()
+	mode := config.ImportMode(q.Get("mode"))
+	if mode == "" {
+		mode = config.ImportMerge
+	}
+	res, err := manager(r).Import(bundle, mode, q.Get("dryRun") == "true")
+	if err != nil && res == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		b, _ = json.Marshal(map[string]string{"error": err.Error()})
+		w.Write(b)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	if !res.Valid {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	b, _ = json.Marshal(res)
+	w.Write(b)
+}
+
+// healthHistory is the number of health checks kept per entry
+const healthHistory = 120
+
+// HealthList returns uptime and recent results of all entries
+func HealthList(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(health.Statuses())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// HealthStatus returns uptime and recent results of a single entry
+func HealthStatus(w http.ResponseWriter, r *http.Request) {
+	s, ok := health.Status(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// Webhooks lists the configured webhooks without their secrets
+func Webhooks(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(notifier.Hooks)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// Deliveries returns the webhook delivery log, newest first
+func Deliveries(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(notifier.Deliveries())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// History lists the versions of the entry, newest first
+func History(w http.ResponseWriter, r *http.Request) {
+	vl, err := config.Manager.History(mux.Vars(r)["id"])
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+	b, err := json.Marshal(vl)
+	if err != nil {
 		panic(err)
 	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// Version returns the file content of a previous version of the entry
+func Version(w http.ResponseWriter, r *http.Request) {
+	v := mux.Vars(r)
+	b, err := config.Manager.VersionContent(v["id"], v["revision"])
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "text/yaml")
+	w.Header().Set("ETag", etag(v["revision"]))
+	w.Write(b)
+}
+
+// Diff compares the revisions given by the from and to query parameters, to
+// defaults to the current content
+func Diff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	d, err := config.Manager.Diff(mux.Vars(r)["id"], q.Get("from"), q.Get("to"))
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+	w.Header().Set("content-type", "text/plain")
+	w.Write([]byte(d))
+}
+
+// Restore makes a previous version the current one, deleted entries are recreated
+func Restore(w http.ResponseWriter, r *http.Request) {
+	var (
+		b   []byte
+		out interface{}
+	)
+	v := mux.Vars(r)
+	c, err := manager(r).Restore(v["id"], v["revision"])
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+	if c.Protocol() != "" {
+		out, err = c.ToStreamInput()
+	} else {
+		out, err = c.ToUserInput()
+	}
+	if err != nil {
+		panic(err)
+	}
+	if b, err = json.Marshal(out); err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set("ETag", etag(c.Revision()))
+	w.Write(b)
+}
+
+// ListDeleted returns the latest version of every deleted entry
+func ListDeleted(w http.ResponseWriter, r *http.Request) {
+	vl, err := config.Manager.Deleted()
+	if err != nil {
+		historyError(w, err)
+		return
+	}
+	b, err := json.Marshal(vl)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// historyError answers history requests for unknown entries or revisions
+func historyError(w http.ResponseWriter, err error) {
+	status := http.StatusNotFound
+	var dc *config.DomainConflict
+	if errors.Is(err, config.ErrHistoryDisabled) {
+		status = http.StatusNotImplemented
+	} else if errors.As(err, &dc) {
+		status = http.StatusConflict
+	}
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
 }
 
 func recovery(next http.Handler) http.Handler {
@@ -193,7 +568,7 @@ type forwardauth struct {
 func Features(w http.ResponseWriter, r *http.Request) {
 	f := features{
 		ForwardAuth: forwardauth{
-			Enabled: appcfg.AuthorizationEndpoint != "",
+			Enabled: auth != nil,
 			URL:     appcfg.AuthorizationEndpoint,
 		},
 	}
@@ -250,29 +625,25 @@ func SetupRoutes(cfg Config) http.Handler {
 	var fs http.Handler
 	appcfg = cfg
 	mux := mux.NewRouter()
-	mux.Use(recovery, securityHeaders)
+	mux.Use(instrument, recovery, securityHeaders)
+	instrumentUnmatched(mux)
 
-	// setup indieauth
-	if appcfg.AuthorizationEndpoint != "" {
-		cookieStore = sessions.NewCookieStore([]byte(appcfg.CookieSecret))
-		ia, err := indieauth.New(cookieStore, "http://localhost/endpoints", appcfg.AuthorizationEndpoint)
+	// setup the login provider
+	if appcfg.AuthEnabled() {
+		a, err := newAuthenticator(appcfg)
 		if err != nil {
 			panic(err)
 		}
+		auth = a
 
-		iaMiddleware := ia.Middleware()
-		mux.HandleFunc(indieauth.DefaultRedirectPath, ia.RedirectHandler)
-		mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
-			ia.Logout(w, r)
-		})
+		mux.HandleFunc(auth.CallbackPath(), auth.RedirectHandler)
+		mux.HandleFunc("/logout", auth.Logout)
 
-		mux.Handle("/auth/verify", iaMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte("authorized"))
-		})))
+		mux.Handle("/auth/verify", requireLogin(auth)(http.HandlerFunc(verify)))
 
 		mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
 			uri := r.Header.Get("X-Forwarded-Uri")
-			if strings.HasPrefix(uri, indieauth.DefaultRedirectPath) {
+			if strings.HasPrefix(uri, auth.CallbackPath()) {
 				r.URL, _ = url.Parse(uri)
 			} else {
 				r.URL.Path = "/auth/verify"
@@ -280,18 +651,60 @@ func SetupRoutes(cfg Config) http.Handler {
 			mux.ServeHTTP(w, r)
 		})
 
-		logger.Info(fmt.Sprintf("enabling forward-auth using endpoint %s", appcfg.AuthorizationEndpoint))
+		logger.Info(fmt.Sprintf("enabling forward-auth using %s", appcfg.AuthProvider))
 	} else {
-		logger.Info("forward-auth middleware not enabled because no authorization endpoint was specified")
+		logger.Info("forward-auth middleware not enabled because the auth provider is not configured")
 	}
 
+	// the export is downloaded by the browser directly, it has no side effects
+	mux.HandleFunc("/config/export", Export).Methods("GET")
 	cfgmux := mux.PathPrefix("/config").Subrouter()
 	cfgmux.Use(requireAjax)
 	cfgmux.HandleFunc("/", List).Methods("GET")
+	cfgmux.HandleFunc("/deleted", ListDeleted).Methods("GET")
+	cfgmux.HandleFunc("/import", Import).Methods("POST")
+	cfgmux.HandleFunc("/{id}/history", History).Methods("GET")
+	cfgmux.HandleFunc("/{id}/history/{revision}", Version).Methods("GET")
+	cfgmux.HandleFunc("/{id}/history/{revision}/restore", Restore).Methods("POST")
+	cfgmux.HandleFunc("/{id}/diff", Diff).Methods("GET")
 	cfgmux.HandleFunc("/{id}", Get).Methods("GET")
 	cfgmux.HandleFunc("/{id}", Save).Methods("POST", "PUT")
 	cfgmux.HandleFunc("/{id}", Delete).Methods("DELETE")
+	streammux := mux.PathPrefix("/streams").Subrouter()
+	streammux.Use(requireAjax)
+	streammux.HandleFunc("/", ListStreams).Methods("GET")
+	streammux.HandleFunc("/{id}", Get).Methods("GET")
+	streammux.HandleFunc("/{id}", SaveStream).Methods("POST", "PUT")
+	streammux.HandleFunc("/{id}", Delete).Methods("DELETE")
 	mux.HandleFunc("/features", Features).Methods("GET")
+	mux.HandleFunc("/events", Events).Methods("GET")
+	mux.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	healthmux := mux.PathPrefix("/health").Subrouter()
+	healthmux.Use(requireAjax)
+	healthmux.HandleFunc("/", HealthList).Methods("GET")
+	healthmux.HandleFunc("/{id}", HealthStatus).Methods("GET")
+	accessmux := mux.PathPrefix("/access").Subrouter()
+	accessmux.Use(requireAjax)
+	accessmux.HandleFunc("/", GetAccess).Methods("GET")
+	accessmux.HandleFunc("/", SaveAccess).Methods("PUT")
+	hookmux := mux.PathPrefix("/webhooks").Subrouter()
+	hookmux.Use(requireAjax)
+	hookmux.HandleFunc("/", Webhooks).Methods("GET")
+	hookmux.HandleFunc("/deliveries", Deliveries).Methods("GET")
+
+	health = monitor.New(appcfg.HealthInterval, healthHistory)
+	health.Probe = appcfg.HealthProbe
+	health.OnCheck = observeCheck
+	registerState.Do(func() {
+		prometheus.MustRegister(newStateCollector(func() *monitor.Monitor { return health }))
+	})
+	notifier = notify.New(appcfg.Webhooks)
+	health.OnChange = func(id string, b config.Backend) {
+		backendHealth(id, b)
+		notifier.BackendChanged(id, b)
+	}
+	go health.Run(context.Background())
+	forwardConfigEvents()
 
 	if cfg.WebRoot != "" {
 		fs = http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.WebRoot)))
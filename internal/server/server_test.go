@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pheelee/traefik-admin/config"
+	"github.com/pheelee/traefik-admin/internal/monitor"
+)
+
+func TestRevisionRequired(t *testing.T) {
+	config.Manager = config.ConfigManager{Path: t.TempDir(), CertResolver: "http01"}
+	defer func() { config.Manager = config.ConfigManager{} }()
+	health = monitor.New(time.Minute, 10)
+	auth = nil
+	c, err := config.Manager.Add(&config.UserInput{Name: "Test", Domain: "test.example.com", Backends: []config.Backend{{URL: "http://127.0.0.1:1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/config/{id}", Save).Methods("PUT")
+	r.HandleFunc("/config/{id}", Delete).Methods("DELETE")
+	serve := func(method string, u *config.UserInput, rev string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(u)
+		req := httptest.NewRequest(method, "/config/"+c.ID(), bytes.NewReader(b))
+		if rev != "" {
+			req.Header.Set("If-Match", etag(rev))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	u, _ := c.ToUserInput()
+	u.Revision = ""
+	u.ForceTLS = true
+	if w := serve("PUT", u, ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Update without revision should be rejected %d", w.Code)
+	}
+	if w := serve("DELETE", nil, ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("Delete without revision should be rejected %d", w.Code)
+	}
+	if config.Manager.Get(c.ID()).Revision() != c.Revision() {
+		t.Fatal("Entry should not change without revision")
+	}
+
+	w := serve("PUT", u, c.Revision())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Update with If-Match should pass %d %s", w.Code, w.Body.String())
+	}
+	u.Revision = c.Revision()
+	if w = serve("PUT", u, ""); w.Code != http.StatusConflict {
+		t.Errorf("Outdated revision in the body should conflict %d", w.Code)
+	}
+	if w = serve("DELETE", nil, config.Manager.Get(c.ID()).Revision()); w.Code != http.StatusOK {
+		t.Errorf("Delete with If-Match should pass %d", w.Code)
+	}
+}
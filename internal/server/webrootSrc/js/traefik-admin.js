@@ -1,25 +1,38 @@
-function ajax(url, method, data, success, failure, progress=true) {
+function ajax(url, method, data, success, failure, progress=true, headers={}) {
   if (progress) Loader.Show();
   var xhr = window.XMLHttpRequest ? new XMLHttpRequest() : new ActiveXObject("Microsoft.XMLHTTP");
   xhr.open(method, url);
   xhr.onreadystatechange = function() {
       if (progress) Loader.Hide();
       if (xhr.readyState>3 && xhr.status==200) { success(xhr.responseText); }
-      if (xhr.readyState>3 && xhr.status > 399) {failure(xhr.responseText); }
+      if (xhr.readyState>3 && xhr.status > 399) {failure(xhr.responseText, xhr.status); }
   };
   xhr.setRequestHeader('X-Requested-With', 'XMLHttpRequest');
   xhr.setRequestHeader('Content-Type', 'application/json');
+  for (var h in headers) { xhr.setRequestHeader(h, headers[h]); }
   xhr.send(JSON.stringify(data));
   return xhr;
 }
 
+function splitList(s) {
+  return s.split(',').map(e => e.trim()).filter(e => e !== '');
+}
+
 var defaults = {
   editor: {
     id: '',
     name: '',
     domain: '',
-    backend: {url: '', healthy: true},
+    rule: {hosts: [], path: [], pathprefix: [], headers: [], methods: [], raw: ''},
+    backends: [
+      {url: '', weight: 0, healthy: true},
+      {url: '', weight: 0, healthy: true},
+      {url: '', weight: 0, healthy: true},
+      {url: '', weight: 0, healthy: true},
+      {url: '', weight: 0, healthy: true},
+    ],
     forwardauth: false,
+    accessPolicy: null,
     https: true,
     forcetls: true,
     hsts: true,
@@ -38,13 +51,36 @@ var defaults = {
       {Username: '', password:''},
     ],
     ipRestriction: {depth: 0, ips: ["","","","",""]},
+    pathRewrite: {stripprefix: [], stripprefixregex: [], addprefix: '', replacepath: '', replacepathregex: {regex: '', replacement: ''}},
+    rateLimit: {average: 0, burst: 0, period: '', sourcecriterion: {depth: 0, header: '', host: false}},
+    inFlight: {amount: 0, sourcecriterion: {depth: 0, header: '', host: false}},
+    loadBalancer: {
+      passhostheader: true,
+      healthcheck: {path: '', interval: '', timeout: '', scheme: '', headers: [
+        {Name:'',Value:''},
+        {Name:'',Value:''},
+        {Name:'',Value:''},
+        {Name:'',Value:''},
+        {Name:'',Value:''},
+      ]},
+      sticky: {enabled: false, name: '', secure: false, httponly: false, samesite: ''},
+    },
   },
+  ruleText: {hosts: '', pathprefix: '', methods: '', stripprefix: '', stripprefixregex: '', allow: '', deny: ''},
   validation: {
     valid: true,
     errors: {
       name: '',
       domain: '',
+      rule: {paths: '', headers: '', methods: '', raw: ''},
       backend: '',
+      backends: [
+        {url:'',weight:''},
+        {url:'',weight:''},
+        {url:'',weight:''},
+        {url:'',weight:''},
+        {url:'',weight:''},
+      ],
       basicauth: [
         {username:'',password:''},
         {username:'',password:''},
@@ -62,7 +98,12 @@ var defaults = {
         {name:'',value:''},
         {name:'',value:''},
         {name:'',value:''},
-      ]
+      ],
+      pathrewrite: {stripprefix: '', stripprefixregex: '', addprefix: '', replacepath: '', replacepathregex: ''},
+      ratelimit: {average: '', burst: '', period: '', sourcecriterion: ''},
+      inflight: {amount: '', sourcecriterion: ''},
+      healthcheck: {path: '', interval: '', timeout: '', scheme: '', headers: ''},
+      sticky: {name: '', samesite: ''}
     }
   }
 }
@@ -86,10 +127,12 @@ var app = new Vue({
       endpoint: '',
       message: 'Proxy Connections',
       connections: [],
+      health: {},
       filter_view:[],
       filter_string: '',
       validation: JSON.parse(JSON.stringify(defaults.validation)),
       editor: JSON.parse(JSON.stringify(defaults.editor)),
+      ruleText: JSON.parse(JSON.stringify(defaults.ruleText)),
       editorMode: 'Create',
     },
     methods: {
@@ -98,6 +141,12 @@ var app = new Vue({
           var firstId = tabs.querySelectorAll("a")[0].href.split("#")[1];
           (M.Tabs.getInstance(tabs)).select(firstId);
           if(app.editor.id === '') {app.editor.id=app.editor.name}
+          app.editor.rule.hosts = [app.editor.domain].concat(splitList(app.ruleText.hosts));
+          app.editor.rule.pathprefix = splitList(app.ruleText.pathprefix);
+          app.editor.rule.methods = splitList(app.ruleText.methods).map(m => m.toUpperCase());
+          app.editor.pathRewrite.stripprefix = splitList(app.ruleText.stripprefix);
+          app.editor.pathRewrite.stripprefixregex = splitList(app.ruleText.stripprefixregex);
+          app.editor.accessPolicy = {allow: splitList(app.ruleText.allow), deny: splitList(app.ruleText.deny)};
             var method = 'POST';
             if(app.editorMode === 'Update'){
               method = 'PUT';
@@ -111,10 +160,14 @@ var app = new Vue({
                 M.Modal.getInstance(document.getElementById(senderId)).close();
                 app.applyFilter();
                 Notify.Success(app.editor.name, "successfully " + app.editorMode.toLowerCase() + "d")
-            }, function(response){
+            }, function(response, status){
+              if (status == 409 || status == 428) {
+                Notify.Error(app.editor.name, "was modified by someone else, please reload")
+                return
+              }
               app.validation = JSON.parse(response);
               Notify.Error(app.editor.name, "failed to create/update")
-            })
+            }, true, app.editor.revision ? {'If-Match': '"' + app.editor.revision + '"'} : {})
         },
         remove: function(event){
           var id = event.target.dataset["id"];
@@ -128,20 +181,34 @@ var app = new Vue({
               app.connections.splice(app.connections.findIndex(e => e.id == app.confirmDialog.id), 1);
               app.applyFilter();
               Notify.Success(name, "config deleted")
-            })
+            }, function(response, status){
+              Notify.Error(name, status == 409 || status == 428 ? "was modified by someone else, please reload" : "failed to delete")
+            }, true, {'If-Match': '"' + c.revision + '"'})
           };
           M.Modal.init(document.getElementById("confirmModal"), {}).open();
         },
         edit: function(event){
           var id = event.target.dataset["id"];
           app.editorMode = 'Update';
-          app.editor = Object.assign({},app.filter_view[id]);
+          app.editor = JSON.parse(JSON.stringify(app.filter_view[id]));
+          while (app.editor.backends.length < defaults.editor.backends.length) {
+            app.editor.backends.push({url: '', weight: 0, healthy: true});
+          }
+          app.ruleText = {
+            hosts: app.editor.rule.hosts.slice(1).join(', '),
+            pathprefix: app.editor.rule.pathprefix.join(', '),
+            methods: app.editor.rule.methods.join(', '),
+            stripprefix: app.editor.pathRewrite.stripprefix.join(', '),
+            stripprefixregex: app.editor.pathRewrite.stripprefixregex.join(', '),
+            allow: app.editor.accessPolicy ? app.editor.accessPolicy.allow.join(', ') : '',
+            deny: app.editor.accessPolicy ? app.editor.accessPolicy.deny.join(', ') : '',
+          };
           M.Modal.getInstance(document.getElementById('editModal')).open();
         },
         applyFilter: function(){
           let filter = app.filter_string.toLowerCase();
           app.filter_view = app.connections.filter(c => 
-            c.domain.toLowerCase().includes(filter) || c.name.toLowerCase().includes(filter) || c.backend.url.toLowerCase().includes(filter)
+            c.domain.toLowerCase().includes(filter) || c.name.toLowerCase().includes(filter) || c.backends.some(b => b.url.toLowerCase().includes(filter))
             );
         },
     }
@@ -178,6 +245,7 @@ var app = new Vue({
     M.Modal.init(document.querySelectorAll('.modal'), {
       onCloseEnd: function(el) {
         app.editor = JSON.parse(JSON.stringify(defaults.editor));
+        app.ruleText = JSON.parse(JSON.stringify(defaults.ruleText));
         app.editorMode = 'Create';
         app.validation = JSON.parse(JSON.stringify(defaults.validation));
         el.querySelectorAll("input").forEach((i) => {
@@ -194,12 +262,45 @@ var app = new Vue({
       }
     });
     M.Tabs.init(document.querySelectorAll(".tabs"), {});
-    ajax('config/','GET',null, function(data){
-        app.connections = JSON.parse(data);
-        app.filter_view = app.connections;
-        document.getElementById("connectionList").style.display = "block";
-    });
+    loadConnections();
     ajax('features', 'GET', null, function(data){
       app.features = JSON.parse(data);
     }, function(){}, false)    
+    listen();
   });
+
+  function loadConnections(progress=true) {
+    ajax('config/','GET',null, function(data){
+        app.connections = JSON.parse(data);
+        app.applyFilter();
+        document.getElementById("connectionList").style.display = "block";
+    }, function(){}, progress);
+    loadHealth();
+  }
+
+  function loadHealth() {
+    ajax('health/','GET',null, function(data){
+      var health = {};
+      JSON.parse(data).forEach(s => health[s.id] = s);
+      app.health = health;
+    }, function(){}, false);
+  }
+
+  // refresh the list when entries change and update the health of backends
+  // pushed by the server, the browser reconnects on its own
+  function listen() {
+    if (!window.EventSource) return;
+    var es = new EventSource('events');
+    var reload = null;
+    es.addEventListener('entry', function(){
+      clearTimeout(reload);
+      reload = setTimeout(function(){ loadConnections(false) }, 500);
+    });
+    es.addEventListener('health', function(e){
+      var h = JSON.parse(e.data);
+      app.connections.filter(c => c.id == h.id).forEach(c => {
+        c.backends.filter(b => b.url == h.url).forEach(b => Object.assign(b, {healthy: h.healthy, unknown: false, statusCode: h.statusCode, error: h.error}));
+      });
+      loadHealth();
+    });
+  }